@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// StatusAPI serves a read-only JSON view of Dotege's current state, to help diagnose why containers aren't being
+// proxied as expected.
+type StatusAPI struct {
+	templates      Templates
+	certificates   *CertificateManager
+	proxyTag       string
+	requireHealthy bool
+
+	mutex      sync.RWMutex
+	containers []ContainerStatus
+	hostnames  []HostnameStatus
+}
+
+// ContainerStatus describes a container Dotege knows about, and whether it is being proxied.
+type ContainerStatus struct {
+	Id      string            `json:"id"`
+	Name    string            `json:"name"`
+	State   string            `json:"state"`
+	Health  string            `json:"health,omitempty"`
+	Labels  map[string]string `json:"labels"`
+	Vhosts  []string          `json:"vhosts"`
+	Path    string            `json:"path"`
+	Port    int               `json:"port"`
+	Proxied bool              `json:"proxied"`
+	// Reasons explains why the container isn't being proxied, if it isn't.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// HostnameStatus describes a hostname and the routes that serve it.
+type HostnameStatus struct {
+	Name         string        `json:"name"`
+	Alternatives []string      `json:"alternatives"`
+	Routes       []RouteStatus `json:"routes"`
+}
+
+// RouteStatus describes a single path-based route for a hostname.
+type RouteStatus struct {
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Containers   []string          `json:"containers"`
+	Headers      map[string]string `json:"headers"`
+	RequiresAuth bool              `json:"requiresAuth"`
+	AuthGroup    string            `json:"authGroup,omitempty"`
+	Balance      string            `json:"balance,omitempty"`
+}
+
+// NewStatusAPI creates a new API serving the status of the given templates and certificates. The certificate
+// manager may be nil if certificate deployment is disabled. The proxy tag and health requirement are used to
+// explain why containers aren't being proxied.
+func NewStatusAPI(templates Templates, certificates *CertificateManager, proxyTag string, requireHealthy bool) *StatusAPI {
+	return &StatusAPI{
+		templates:      templates,
+		certificates:   certificates,
+		proxyTag:       proxyTag,
+		requireHealthy: requireHealthy,
+		containers:     []ContainerStatus{},
+		hostnames:      []HostnameStatus{},
+	}
+}
+
+// Update replaces the container and hostname information served by the API. Ignored containers are those that
+// were skipped because their proxy tag didn't match.
+func (s *StatusAPI) Update(containers, ignored Containers, hostnames map[string]*Hostname) {
+	containerStatuses := make([]ContainerStatus, 0, len(containers)+len(ignored))
+	for _, c := range containers {
+		reasons := c.IgnoredReasons(s.requireHealthy)
+		containerStatuses = append(containerStatuses, newContainerStatus(c, reasons))
+	}
+	for _, c := range ignored {
+		reason := fmt.Sprintf("proxy tag mismatch (wanted '%s', got '%s')", s.proxyTag, c.Labels[labelProxyTag])
+		containerStatuses = append(containerStatuses, newContainerStatus(c, []string{reason}))
+	}
+	sort.Slice(containerStatuses, func(i, j int) bool {
+		return containerStatuses[i].Name < containerStatuses[j].Name
+	})
+
+	hostnameStatuses := make([]HostnameStatus, 0, len(hostnames))
+	for _, h := range hostnames {
+		hostnameStatuses = append(hostnameStatuses, newHostnameStatus(h))
+	}
+	sort.Slice(hostnameStatuses, func(i, j int) bool {
+		return hostnameStatuses[i].Name < hostnameStatuses[j].Name
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.containers = containerStatuses
+	s.hostnames = hostnameStatuses
+}
+
+func newContainerStatus(c *Container, reasons []string) ContainerStatus {
+	return ContainerStatus{
+		Id:      c.Id,
+		Name:    c.Name,
+		State:   c.State,
+		Health:  c.Health,
+		Labels:  c.Labels,
+		Vhosts:  c.Vhosts(),
+		Path:    c.Path(),
+		Port:    c.Port(),
+		Proxied: len(reasons) == 0,
+		Reasons: reasons,
+	}
+}
+
+func newHostnameStatus(h *Hostname) HostnameStatus {
+	res := HostnameStatus{
+		Name:         h.Name,
+		Alternatives: []string{},
+		Routes:       []RouteStatus{},
+	}
+
+	for a := range h.Alternatives {
+		res.Alternatives = append(res.Alternatives, a)
+	}
+	sort.Strings(res.Alternatives)
+
+	for _, r := range h.Routes {
+		route := RouteStatus{
+			Name:         r.Name,
+			Path:         r.Path,
+			Containers:   []string{},
+			Headers:      r.Headers,
+			RequiresAuth: r.RequiresAuth,
+			AuthGroup:    r.AuthGroup,
+			Balance:      r.Balance,
+		}
+		for _, c := range r.Containers {
+			route.Containers = append(route.Containers, c.Name)
+		}
+		res.Routes = append(res.Routes, route)
+	}
+	return res
+}
+
+// register adds the API's handlers to the given mux.
+func (s *StatusAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/containers", s.handleContainers)
+	mux.HandleFunc("/api/hostnames", s.handleHostnames)
+	mux.HandleFunc("/api/certificates", s.handleCertificates)
+	mux.HandleFunc("/api/templates", s.handleTemplates)
+}
+
+func (s *StatusAPI) handleContainers(w http.ResponseWriter, _ *http.Request) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	writeJSON(w, s.containers)
+}
+
+func (s *StatusAPI) handleHostnames(w http.ResponseWriter, _ *http.Request) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	writeJSON(w, s.hostnames)
+}
+
+func (s *StatusAPI) handleCertificates(w http.ResponseWriter, _ *http.Request) {
+	certificates := []CertificateInfo{}
+	if s.certificates != nil {
+		certificates = s.certificates.Certificates()
+	}
+	writeJSON(w, certificates)
+}
+
+func (s *StatusAPI) handleTemplates(w http.ResponseWriter, _ *http.Request) {
+	templates := make([]TemplateStatus, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, t.Status())
+	}
+	writeJSON(w, templates)
+}
+
+// writeJSON serialises the given value as an indented JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		loggers.main.Warnf("Unable to write API response: %s", err.Error())
+	}
+}
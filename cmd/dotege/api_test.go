@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCertificate creates a PEM-encoded certificate for the given domains, signed by an issuer with the given
+// common name.
+func selfSignedCertificate(t *testing.T, issuer string, domains []string, notBefore, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: issuer},
+		DNSNames:     domains,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: issuer}}, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func apiRequest(t *testing.T, api *StatusAPI, path string, target interface{}) {
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), target))
+}
+
+func Test_StatusAPI_containers(t *testing.T) {
+	api := NewStatusAPI(nil, nil, "public", false)
+
+	containers := Containers{
+		"web":     {Id: "web", Name: "web", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80", labelProxyTag: "public"}},
+		"noport":  {Id: "noport", Name: "noport", State: StateRunning, Labels: map[string]string{labelVhost: "example.org", labelProxyTag: "public"}, Ports: []int{80, 443}},
+		"badport": {Id: "badport", Name: "badport", State: StateRunning, Labels: map[string]string{labelVhost: "example.net", labelProxy: "http", labelProxyTag: "public"}},
+		"novhost": {Id: "novhost", Name: "novhost", State: StateRunning, Labels: map[string]string{labelProxy: "80", labelProxyTag: "public"}},
+	}
+	ignored := Containers{
+		"other": {Id: "other", Name: "other", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxyTag: "private"}},
+	}
+	api.Update(containers, ignored, containers.Hostnames(false))
+
+	var res []ContainerStatus
+	apiRequest(t, api, "/api/containers", &res)
+	require.Len(t, res, 5)
+
+	assert.Equal(t, "badport", res[0].Name)
+	assert.False(t, res[0].Proxied)
+	assert.Equal(t, []string{"invalid port label: http"}, res[0].Reasons)
+
+	assert.Equal(t, "noport", res[1].Name)
+	assert.Equal(t, []string{"no port label, and container exposes 2 ports"}, res[1].Reasons)
+
+	assert.Equal(t, "novhost", res[2].Name)
+	assert.Equal(t, []string{"no vhost label"}, res[2].Reasons)
+
+	assert.Equal(t, "other", res[3].Name)
+	assert.Equal(t, []string{"proxy tag mismatch (wanted 'public', got 'private')"}, res[3].Reasons)
+
+	assert.Equal(t, "web", res[4].Name)
+	assert.True(t, res[4].Proxied)
+	assert.Empty(t, res[4].Reasons)
+	assert.Equal(t, []string{"example.com"}, res[4].Vhosts)
+	assert.Equal(t, 80, res[4].Port)
+}
+
+func Test_StatusAPI_hostnames(t *testing.T) {
+	api := NewStatusAPI(nil, nil, "", false)
+
+	containers := Containers{
+		"web": {Id: "web", Name: "web", State: StateRunning, Labels: map[string]string{labelVhost: "example.com www.example.com", labelProxy: "80"}},
+		"api": {Id: "api", Name: "api", State: StateRunning, Labels: map[string]string{labelVhost: "example.com/api", labelProxy: "80", labelAuth: "admins"}},
+	}
+	api.Update(containers, nil, containers.Hostnames(false))
+
+	var res []HostnameStatus
+	apiRequest(t, api, "/api/hostnames", &res)
+	require.Len(t, res, 1)
+	assert.Equal(t, "example.com", res[0].Name)
+	assert.Equal(t, []string{"www.example.com"}, res[0].Alternatives)
+	require.Len(t, res[0].Routes, 2)
+	assert.Equal(t, RouteStatus{Name: "example_com_Sapi", Path: "/api", Containers: []string{"api"}, Headers: map[string]string{}, RequiresAuth: true, AuthGroup: "admins"}, res[0].Routes[0])
+	assert.Equal(t, RouteStatus{Name: "example_com", Path: "/", Containers: []string{"web"}, Headers: map[string]string{}}, res[0].Routes[1])
+}
+
+func Test_StatusAPI_certificates(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	notAfter := time.Now().Add(time.Hour * 24 * 60).Truncate(time.Second).UTC()
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", "")
+	cm.data = &CertificateManagerData{Certs: []*SavedCertificate{
+		{Domains: []string{"example.org"}, NotAfter: notAfter, Certificate: selfSignedCertificate(t, "Test CA", []string{"example.org"}, notBefore, notAfter)},
+		{Domains: []string{"example.com", "www.example.com"}, NotAfter: notAfter, Certificate: selfSignedCertificate(t, "Test CA", []string{"example.com"}, notBefore, notAfter)},
+	}}
+
+	var res []CertificateInfo
+	apiRequest(t, NewStatusAPI(nil, cm, "", false), "/api/certificates", &res)
+	require.Len(t, res, 2)
+	assert.Equal(t, CertificateInfo{Domains: []string{"example.com", "www.example.com"}, Issuer: "CN=Test CA", NotBefore: notBefore, NotAfter: notAfter}, res[0])
+	assert.Equal(t, []string{"example.org"}, res[1].Domains)
+
+	// Certificate deployment may be disabled entirely
+	apiRequest(t, NewStatusAPI(nil, nil, "", false), "/api/certificates", &res)
+	assert.Empty(t, res)
+}
+
+func Test_StatusAPI_templates(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.tpl")
+	destination := filepath.Join(dir, "a.out")
+	require.NoError(t, os.WriteFile(source, []byte("{{ . }}"), 0600))
+	tpl := CreateTemplate(source, destination, nil, nil, validatorFunc(func(path string) error {
+		return &ValidationError{assert.AnError}
+	}))
+	api := NewStatusAPI(Templates{tpl}, nil, "", false)
+
+	var res []TemplateStatus
+	apiRequest(t, api, "/api/templates", &res)
+	require.Len(t, res, 1)
+	assert.Equal(t, source, res[0].Source)
+	assert.Equal(t, destination, res[0].Destination)
+	assert.True(t, res[0].LastRender.IsZero())
+
+	Templates{tpl}.Generate("content")
+	apiRequest(t, api, "/api/templates", &res)
+	assert.False(t, res[0].LastRender.IsZero())
+	assert.True(t, res[0].LastUpdate.IsZero())
+	assert.Contains(t, res[0].Error, "validation failed")
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/lego"
@@ -31,6 +33,12 @@ const (
 	envAcmeKeyTypeDefault           = "P384"
 	envAcmeCacheLocationKey         = "DOTEGE_ACME_CACHE_FILE"
 	envAcmeCacheLocationDefault     = "/data/config/certs.json"
+	envAcmeChallengeKey             = "DOTEGE_ACME_CHALLENGE"
+	envAcmeChallengeDefault         = AcmeChallengeDns
+	envAcmeHttpAddressKey           = "DOTEGE_ACME_HTTP_ADDRESS"
+	envAcmeHttpAddressDefault       = ":5002"
+	envAcmeHttpBackendKey           = "DOTEGE_ACME_HTTP_BACKEND"
+	envAcmeHttpBackendDefault       = ""
 	envSignalContainerKey           = "DOTEGE_SIGNAL_CONTAINER"
 	envSignalContainerDefault       = ""
 	envSignalTypeKey                = "DOTEGE_SIGNAL_TYPE"
@@ -39,39 +47,83 @@ const (
 	envTemplateDestinationDefault   = "/data/output/haproxy.cfg"
 	envTemplateSourceKey            = "DOTEGE_TEMPLATE_SOURCE"
 	envTemplateSourceDefault        = "./templates/haproxy.cfg.tpl"
+	envTemplatePartialsKey          = "DOTEGE_TEMPLATE_PARTIALS"
+	envTemplateValidateCommandKey   = "DOTEGE_TEMPLATE_VALIDATE_COMMAND"
+	envTemplateValidateContainerKey = "DOTEGE_TEMPLATE_VALIDATE_CONTAINER"
+	envTemplateValidateDirectoryKey = "DOTEGE_TEMPLATE_VALIDATE_DIRECTORY"
 	envUsersKey                     = "DOTEGE_USERS"
-	envUsersDefault                 = ""
+	envUsersFileKey                 = "DOTEGE_USERS_FILE"
 	envWildcardDomainsKey           = "DOTEGE_WILDCARD_DOMAINS"
-	envWildcardDomainsDefault       = ""
 	envProxyTagKey                  = "DOTEGE_PROXYTAG"
 	envProxyTagDefault              = ""
 	envCertificateDeploymentKey     = "DOTEGE_CERTIFICATE_DEPLOYMENT"
 	envCertificateDeploymentDefault = CertificateDeploymentCombined
+	envHAProxySocketKey             = "DOTEGE_HAPROXY_SOCKET"
+	envHAProxyCertPathKey           = "DOTEGE_HAPROXY_CERT_PATH"
+	envHAProxyCrtListKey            = "DOTEGE_HAPROXY_CRT_LIST"
+	envListenAddressKey             = "DOTEGE_LISTEN_ADDRESS"
+	envListenAddressDefault         = ""
+	envRequireHealthyKey            = "DOTEGE_REQUIRE_HEALTHY"
+	envRequireHealthyDefault        = false
+	envResyncIntervalKey            = "DOTEGE_RESYNC_INTERVAL"
+	envResyncIntervalDefault        = 30 * time.Second
+	envSwarmKey                     = "DOTEGE_SWARM"
+	envSwarmDefault                 = false
+	envStaticRoutesFileKey          = "DOTEGE_STATIC_ROUTES_FILE"
+	envCertGCKey                    = "DOTEGE_CERT_GC"
+	envCertGCDefault                = CertificateGCDisabled
+	envCertGCGracePeriodKey         = "DOTEGE_CERT_GC_GRACE_PERIOD"
+	envCertGCGracePeriodDefault     = 7 * 24 * time.Hour
 )
 
+// fileSuffix may be appended to the name of any environment variable to read its value from a file instead.
+const fileSuffix = "_FILE"
+
 const (
 	CertificateDeploymentCombined = "combined"
 	CertificateDeploymentSplit    = "splitkeys"
 	CertificateDeploymentDisabled = "disabled"
 )
 
+const (
+	CertificateGCDisabled = "disabled"
+	CertificateGCDryRun   = "dryrun"
+	CertificateGCEnabled  = "enabled"
+)
+
 // Config is the user-definable configuration for Dotege.
 type Config struct {
-	Templates              []TemplateConfig
-	Signals                []ContainerSignal
-	DefaultCertDestination string
-	CertUid                int
-	CertGid                int
-	CertMode               os.FileMode
-	Acme                   AcmeConfig
-	WildCardDomains        []string
-	Users                  []User
-	ProxyTag               string
-	CertificateDeployment  string
-
-	DebugContainers bool
-	DebugHeaders    bool
-	DebugHostnames  bool
+	Templates              []TemplateConfig  `yaml:"templates"`
+	TemplatePartials       []string          `yaml:"template_partials"`
+	Signals                []ContainerSignal `yaml:"signals"`
+	DefaultCertDestination string            `yaml:"cert_destination"`
+	CertUid                int               `yaml:"cert_uid"`
+	CertGid                int               `yaml:"cert_gid"`
+	CertMode               os.FileMode       `yaml:"cert_mode"`
+	Acme                   AcmeConfig        `yaml:"acme"`
+	WildCardDomains        []string          `yaml:"wildcard_domains"`
+	Users                  []User            `yaml:"users"`
+	UsersFile              string            `yaml:"users_file"`
+	ProxyTag               string            `yaml:"proxytag"`
+	CertificateDeployment  string            `yaml:"certificate_deployment"`
+	HAProxy                HAProxyConfig     `yaml:"haproxy"`
+	ListenAddress          string            `yaml:"listen_address"`
+	RequireHealthy         bool              `yaml:"require_healthy"`
+	ResyncInterval         time.Duration     `yaml:"resync_interval"`
+	Swarm                  bool              `yaml:"swarm"`
+	StaticRoutesFile       string            `yaml:"static_routes_file"`
+	CertGC                 string            `yaml:"cert_gc"`
+	CertGCGracePeriod      time.Duration     `yaml:"cert_gc_grace_period"`
+
+	DebugContainers bool `yaml:"-"`
+	DebugHeaders    bool `yaml:"-"`
+	DebugHostnames  bool `yaml:"-"`
+}
+
+// configFile is the on-disk representation of Config, with settings that don't map directly onto it.
+type configFile struct {
+	Config `yaml:",inline"`
+	Debug  []string `yaml:"debug"`
 }
 
 // User holds the details of a single user used for ACL purposes.
@@ -83,35 +135,81 @@ type User struct {
 
 // TemplateConfig configures a single template for the generator.
 type TemplateConfig struct {
-	Source      string
-	Destination string
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+
+	// Signals to send when this template changes. If empty, the global signals are used.
+	Signals []ContainerSignal `yaml:"signals"`
+
+	// Validate describes how to check the generated output before it's used.
+	Validate ValidateConfig `yaml:"validate"`
+}
+
+// ValidateConfig describes a command used to check a template's output before it replaces the previous version.
+type ValidateConfig struct {
+	// Command to run, with "{{file}}" replaced by the path of the generated file. If empty, no validation is done.
+	Command string `yaml:"command"`
+	// Container to run the command in using docker exec. If empty, the command is run locally.
+	Container string `yaml:"container"`
+	// Directory the container sees the destination directory as. If empty, the same path is used.
+	Directory string `yaml:"directory"`
 }
 
 // ContainerSignal describes a container that should be sent a signal when the config/certs change.
 type ContainerSignal struct {
-	Name   string
-	Signal string
+	Name   string `yaml:"name"`
+	Signal string `yaml:"signal"`
+}
+
+// HAProxyConfig describes how to update certificates using HAProxy's runtime API.
+type HAProxyConfig struct {
+	// Socket is the address of the runtime API socket. If empty, the runtime API is not used.
+	Socket string `yaml:"socket"`
+	// CertPath is the directory that certificates are loaded from, as seen by HAProxy.
+	CertPath string `yaml:"cert_path"`
+	// CrtList is the crt-list (or certificate directory) new certificates are added to, as seen by HAProxy.
+	CrtList string `yaml:"crt_list"`
 }
 
 // AcmeConfig describes the configuration to use for getting certs using ACME.
 type AcmeConfig struct {
-	Email         string
-	DnsProvider   string
-	Endpoint      string
-	KeyType       certcrypto.KeyType
-	CacheLocation string
+	Email         string             `yaml:"email"`
+	DnsProvider   string             `yaml:"dns_provider"`
+	Endpoint      string             `yaml:"endpoint"`
+	KeyType       certcrypto.KeyType `yaml:"key_type"`
+	CacheLocation string             `yaml:"cache_file"`
+	Challenge     string             `yaml:"challenge"`
+	HttpAddress   string             `yaml:"http_address"`
+	HttpBackend   string             `yaml:"http_backend"`
+}
+
+func requiredStringVar(key string, fallback string) string {
+	value := optionalStringVar(key, fallback)
+	if value == "" {
+		panic(fmt.Errorf("required setting not defined: %s", key))
+	}
+	return value
 }
 
-func requiredStringVar(key string) (value string) {
+// lookupVar returns the value of the given environment variable. If it's not set but a variant with a "_FILE"
+// suffix is, the value is read from the file that variable names instead.
+func lookupVar(key string) (string, bool) {
 	value, ok := os.LookupEnv(key)
-	if !ok {
-		panic(fmt.Errorf("required environmental variable not defined: %s", key))
+	file, fileOk := os.LookupEnv(key + fileSuffix)
+	if ok && fileOk {
+		panic(fmt.Errorf("only one of %s and %s%s may be defined", key, key, fileSuffix))
+	} else if fileOk {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			panic(fmt.Errorf("unable to read %s%s: %w", key, fileSuffix, err))
+		}
+		return strings.TrimRight(string(buf), "\r\n"), true
 	}
-	return
+	return value, ok
 }
 
 func optionalStringVar(key string, fallback string) (value string) {
-	value, ok := os.LookupEnv(key)
+	value, ok := lookupVar(key)
 	if !ok {
 		value = fallback
 	}
@@ -119,7 +217,7 @@ func optionalStringVar(key string, fallback string) (value string) {
 }
 
 func optionalIntVar(key string, fallback int) int {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := lookupVar(key); ok {
 		if num, err := strconv.Atoi(value); err == nil {
 			return num
 		}
@@ -127,8 +225,26 @@ func optionalIntVar(key string, fallback int) int {
 	return fallback
 }
 
+func optionalBoolVar(key string, fallback bool) bool {
+	if value, ok := lookupVar(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func optionalDurationVar(key string, fallback time.Duration) time.Duration {
+	if value, ok := lookupVar(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
 func optionalFilemodeVar(key string, fallback os.FileMode) os.FileMode {
-	if value, ok := os.LookupEnv(key); ok {
+	if value, ok := lookupVar(key); ok {
 		if num, err := strconv.ParseInt(value, 8, 64); err == nil {
 			return os.FileMode(num)
 		}
@@ -136,64 +252,231 @@ func optionalFilemodeVar(key string, fallback os.FileMode) os.FileMode {
 	return fallback
 }
 
-func createSignalConfig() []ContainerSignal {
-	name := optionalStringVar(envSignalContainerKey, envSignalContainerDefault)
-	if name == envSignalContainerDefault {
-		return []ContainerSignal{}
-	} else {
-		return []ContainerSignal{
-			{
-				Name:   name,
-				Signal: optionalStringVar(envSignalTypeKey, envSignalTypeDefault),
-			},
+func createSignalConfig(signals []ContainerSignal) []ContainerSignal {
+	if name, ok := lookupVar(envSignalContainerKey); ok {
+		if name == envSignalContainerDefault {
+			return []ContainerSignal{}
+		}
+		signals = []ContainerSignal{{Name: name}}
+	}
+
+	return withDefaultSignalTypes(signals)
+}
+
+// withDefaultSignalTypes returns a copy of the given signals, with the default signal type applied to any that
+// don't specify one.
+func withDefaultSignalTypes(signals []ContainerSignal) []ContainerSignal {
+	res := make([]ContainerSignal, len(signals))
+	for i := range signals {
+		res[i] = signals[i]
+		if res[i].Signal == "" {
+			res[i].Signal = optionalStringVar(envSignalTypeKey, envSignalTypeDefault)
+		}
+	}
+	return res
+}
+
+func createTemplateConfig(templates []TemplateConfig) []TemplateConfig {
+	res := []TemplateConfig{{Source: envTemplateSourceDefault, Destination: envTemplateDestinationDefault}}
+	if len(templates) > 0 {
+		res = append([]TemplateConfig(nil), templates...)
+	}
+	res[0].Source = optionalStringVar(envTemplateSourceKey, res[0].Source)
+	res[0].Destination = optionalStringVar(envTemplateDestinationKey, res[0].Destination)
+	res[0].Validate.Command = optionalStringVar(envTemplateValidateCommandKey, res[0].Validate.Command)
+	res[0].Validate.Container = optionalStringVar(envTemplateValidateContainerKey, res[0].Validate.Container)
+	res[0].Validate.Directory = optionalStringVar(envTemplateValidateDirectoryKey, res[0].Validate.Directory)
+
+	for i := range res {
+		if len(res[i].Signals) > 0 {
+			res[i].Signals = withDefaultSignalTypes(res[i].Signals)
 		}
 	}
+	return res
 }
 
-func createConfig() *Config {
-	debug := toMap(splitList(strings.ToLower(optionalStringVar(envDebugKey, ""))))
-	c := &Config{
-		Templates: []TemplateConfig{
-			{
-				Source:      optionalStringVar(envTemplateSourceKey, envTemplateSourceDefault),
-				Destination: optionalStringVar(envTemplateDestinationKey, envTemplateDestinationDefault),
+// createConfig builds the configuration from the given config file (if any), with any environment
+// variables overriding values defined in the file.
+func createConfig(path string) *Config {
+	file := &configFile{
+		Config: Config{
+			DefaultCertDestination: envCertDestinationDefault,
+			CertUid:                envCertUserIdDefault,
+			CertGid:                envCertGroupIdDefault,
+			CertMode:               envCertModeDefault,
+			WildCardDomains:        []string{},
+			ProxyTag:               envProxyTagDefault,
+			ListenAddress:          envListenAddressDefault,
+			RequireHealthy:         envRequireHealthyDefault,
+			ResyncInterval:         envResyncIntervalDefault,
+			Swarm:                  envSwarmDefault,
+			CertificateDeployment:  envCertificateDeploymentDefault,
+			CertGC:                 envCertGCDefault,
+			CertGCGracePeriod:      envCertGCGracePeriodDefault,
+			Acme: AcmeConfig{
+				Endpoint:      lego.LEDirectoryProduction,
+				KeyType:       envAcmeKeyTypeDefault,
+				CacheLocation: envAcmeCacheLocationDefault,
+				Challenge:     envAcmeChallengeDefault,
+				HttpAddress:   envAcmeHttpAddressDefault,
+				HttpBackend:   envAcmeHttpBackendDefault,
 			},
 		},
-		Signals:                createSignalConfig(),
-		DefaultCertDestination: optionalStringVar(envCertDestinationKey, envCertDestinationDefault),
-		CertGid:                optionalIntVar(envCertGroupIdKey, envCertGroupIdDefault),
-		CertUid:                optionalIntVar(envCertUserIdKey, envCertUserIdDefault),
-		CertMode:               optionalFilemodeVar(envCertModeKey, envCertModeDefault),
-		WildCardDomains:        splitList(optionalStringVar(envWildcardDomainsKey, envWildcardDomainsDefault)),
-		Users:                  readUsers(),
-		ProxyTag:               optionalStringVar(envProxyTagKey, envProxyTagDefault),
-		CertificateDeployment:  optionalStringVar(envCertificateDeploymentKey, envCertificateDeploymentDefault),
+	}
+
+	if path != "" {
+		if err := readConfigFile(path, file); err != nil {
+			panic(fmt.Errorf("unable to read config file %s: %w", path, err))
+		}
+	}
+
+	debug := toMap(splitList(strings.ToLower(optionalStringVar(envDebugKey, strings.Join(file.Debug, ",")))))
+	c := &file.Config
+	c.Templates = createTemplateConfig(c.Templates)
+	if value, ok := lookupVar(envTemplatePartialsKey); ok {
+		c.TemplatePartials = splitList(value)
+	}
+	c.Signals = createSignalConfig(c.Signals)
+	c.DefaultCertDestination = optionalStringVar(envCertDestinationKey, c.DefaultCertDestination)
+	c.CertGid = optionalIntVar(envCertGroupIdKey, c.CertGid)
+	c.CertUid = optionalIntVar(envCertUserIdKey, c.CertUid)
+	c.CertMode = optionalFilemodeVar(envCertModeKey, c.CertMode)
+	c.Users, c.UsersFile = readUsers(c.Users, c.UsersFile)
+	c.ProxyTag = optionalStringVar(envProxyTagKey, c.ProxyTag)
+	c.CertificateDeployment = optionalStringVar(envCertificateDeploymentKey, c.CertificateDeployment)
+	c.ListenAddress = optionalStringVar(envListenAddressKey, c.ListenAddress)
+	c.RequireHealthy = optionalBoolVar(envRequireHealthyKey, c.RequireHealthy)
+	c.ResyncInterval = optionalDurationVar(envResyncIntervalKey, c.ResyncInterval)
+	if c.ResyncInterval <= 0 {
+		panic(fmt.Errorf("invalid resync interval: %s", c.ResyncInterval))
+	}
+	c.Swarm = optionalBoolVar(envSwarmKey, c.Swarm)
+	c.StaticRoutesFile = optionalStringVar(envStaticRoutesFileKey, c.StaticRoutesFile)
+	c.CertGC = optionalStringVar(envCertGCKey, c.CertGC)
+	if c.CertGC != CertificateGCDisabled && c.CertGC != CertificateGCDryRun && c.CertGC != CertificateGCEnabled {
+		panic(fmt.Errorf("invalid certificate garbage collection mode: %s", c.CertGC))
+	}
+	c.CertGCGracePeriod = optionalDurationVar(envCertGCGracePeriodKey, c.CertGCGracePeriod)
+	if c.CertGCGracePeriod < 0 {
+		panic(fmt.Errorf("invalid certificate garbage collection grace period: %s", c.CertGCGracePeriod))
+	}
+	c.DebugContainers = debug[envDebugContainersValue]
+	c.DebugHeaders = debug[envDebugHeadersValue]
+	c.DebugHostnames = debug[envDebugHostnamesValue]
 
-		DebugContainers: debug[envDebugContainersValue],
-		DebugHeaders:    debug[envDebugHeadersValue],
-		DebugHostnames:  debug[envDebugHostnamesValue],
+	if value, ok := lookupVar(envWildcardDomainsKey); ok {
+		c.WildCardDomains = splitList(value)
+	}
+
+	c.HAProxy.Socket = optionalStringVar(envHAProxySocketKey, c.HAProxy.Socket)
+	c.HAProxy.CertPath = optionalStringVar(envHAProxyCertPathKey, c.HAProxy.CertPath)
+	if c.HAProxy.CertPath == "" {
+		c.HAProxy.CertPath = c.DefaultCertDestination
+	}
+	c.HAProxy.CrtList = optionalStringVar(envHAProxyCrtListKey, c.HAProxy.CrtList)
+	if c.HAProxy.CrtList == "" {
+		c.HAProxy.CrtList = c.HAProxy.CertPath
 	}
 
 	if c.CertificateDeployment != CertificateDeploymentDisabled {
+		challenge := optionalStringVar(envAcmeChallengeKey, c.Acme.Challenge)
+		if challenge != AcmeChallengeDns && challenge != AcmeChallengeHttp {
+			panic(fmt.Errorf("invalid ACME challenge type: %s", challenge))
+		}
+
+		dnsProvider := optionalStringVar(envDnsProviderKey, c.Acme.DnsProvider)
+		if challenge == AcmeChallengeDns {
+			dnsProvider = requiredStringVar(envDnsProviderKey, c.Acme.DnsProvider)
+		}
+
 		c.Acme = AcmeConfig{
-			DnsProvider:   requiredStringVar(envDnsProviderKey),
-			Email:         requiredStringVar(envAcmeEmailKey),
-			Endpoint:      optionalStringVar(envAcmeEndpointKey, lego.LEDirectoryProduction),
-			KeyType:       certcrypto.KeyType(optionalStringVar(envAcmeKeyTypeKey, envAcmeKeyTypeDefault)),
-			CacheLocation: optionalStringVar(envAcmeCacheLocationKey, envAcmeCacheLocationDefault),
+			DnsProvider:   dnsProvider,
+			Email:         requiredStringVar(envAcmeEmailKey, c.Acme.Email),
+			Endpoint:      optionalStringVar(envAcmeEndpointKey, c.Acme.Endpoint),
+			KeyType:       certcrypto.KeyType(optionalStringVar(envAcmeKeyTypeKey, string(c.Acme.KeyType))),
+			CacheLocation: optionalStringVar(envAcmeCacheLocationKey, c.Acme.CacheLocation),
+			Challenge:     challenge,
+			HttpAddress:   optionalStringVar(envAcmeHttpAddressKey, c.Acme.HttpAddress),
+			HttpBackend:   optionalStringVar(envAcmeHttpBackendKey, c.Acme.HttpBackend),
 		}
+	} else {
+		c.Acme = AcmeConfig{}
 	}
 
 	return c
 }
 
-func readUsers() []User {
-	var users []User
-	err := yaml.Unmarshal([]byte(optionalStringVar(envUsersKey, envUsersDefault)), &users)
+// readConfigFile parses the YAML config file at the given path into the given struct. Any keys not present in
+// the file are left untouched.
+func readConfigFile(path string, file *configFile) error {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(fmt.Errorf("unable to parse users struct: %s", err))
+		return err
+	}
+	return yaml.UnmarshalStrict(buf, file)
+}
+
+// readUsers returns the users defined inline in the environment, or read from the users file if one is configured.
+// The path of the users file is returned so that it can be watched for changes.
+func readUsers(fallback []User, fallbackFile string) ([]User, string) {
+	value, ok := os.LookupEnv(envUsersKey)
+	file, fileOk := os.LookupEnv(envUsersFileKey)
+	if ok && fileOk {
+		panic(fmt.Errorf("only one of %s and %s may be defined", envUsersKey, envUsersFileKey))
+	} else if ok {
+		var users []User
+		err := yaml.Unmarshal([]byte(value), &users)
+		if err != nil {
+			panic(fmt.Errorf("unable to parse users struct: %s", err))
+		}
+		return users, ""
+	} else if !fileOk {
+		file = fallbackFile
+	}
+
+	if file == "" {
+		return fallback, ""
+	}
+
+	users, err := readUsersFile(file)
+	if err != nil {
+		panic(fmt.Errorf("unable to read users file %s: %w", file, err))
+	}
+	return users, file
+}
+
+// readUsersFile reads users from the given file, which may either contain a YAML list of users or be in htpasswd
+// format. Lines in htpasswd files may have a third field containing a comma-separated list of groups.
+func readUsersFile(path string) ([]User, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := yaml.UnmarshalStrict(buf, &users); err == nil {
+		return users, nil
+	}
+
+	users = []User{}
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid user on line %d: not valid YAML or htpasswd format", i+1)
+		}
+
+		user := User{Name: parts[0], Password: parts[1]}
+		if len(parts) == 3 {
+			user.Groups = splitList(parts[2])
+		}
+		users = append(users, user)
 	}
-	return users
+	return users, nil
 }
 
 func splitList(input string) (result []string) {
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_splitList(t *testing.T) {
@@ -29,3 +37,259 @@ func Test_splitList(t *testing.T) {
 		})
 	}
 }
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dotege.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func Test_createConfig_defaults(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+
+	c := createConfig("")
+	assert.Equal(t, []TemplateConfig{{Source: envTemplateSourceDefault, Destination: envTemplateDestinationDefault}}, c.Templates)
+	assert.Equal(t, []ContainerSignal{}, c.Signals)
+	assert.Equal(t, envCertDestinationDefault, c.DefaultCertDestination)
+	assert.Equal(t, os.FileMode(envCertModeDefault), c.CertMode)
+	assert.Equal(t, []string{}, c.WildCardDomains)
+	assert.Equal(t, envResyncIntervalDefault, c.ResyncInterval)
+	assert.Equal(t, CertificateGCDisabled, c.CertGC)
+	assert.Equal(t, envCertGCGracePeriodDefault, c.CertGCGracePeriod)
+}
+
+func Test_createConfig_file(t *testing.T) {
+	path := writeConfigFile(t, `
+templates:
+  - source: /templates/haproxy.cfg.tpl
+    destination: /data/output/haproxy.cfg
+  - source: /templates/domains.txt.tpl
+    destination: /data/output/domains.txt
+signals:
+  - name: haproxy
+    signal: USR2
+  - name: other
+cert_mode: 0640
+wildcard_domains: [example.com]
+users:
+  - name: chris
+    password: hash
+    groups: [admins]
+acme:
+  email: test@example.com
+  dns_provider: httpreq
+  key_type: "2048"
+debug: [containers, hostnames]
+resync_interval: 5m
+template_partials: [/templates/partials]
+`)
+
+	c := createConfig(path)
+	assert.Equal(t, []TemplateConfig{
+		{Source: "/templates/haproxy.cfg.tpl", Destination: "/data/output/haproxy.cfg"},
+		{Source: "/templates/domains.txt.tpl", Destination: "/data/output/domains.txt"},
+	}, c.Templates)
+	assert.Equal(t, []ContainerSignal{{Name: "haproxy", Signal: "USR2"}, {Name: "other", Signal: envSignalTypeDefault}}, c.Signals)
+	assert.Equal(t, os.FileMode(0640), c.CertMode)
+	assert.Equal(t, []string{"example.com"}, c.WildCardDomains)
+	assert.Equal(t, []User{{Name: "chris", Password: "hash", Groups: []string{"admins"}}}, c.Users)
+	assert.Equal(t, "test@example.com", c.Acme.Email)
+	assert.Equal(t, "httpreq", c.Acme.DnsProvider)
+	assert.Equal(t, certcrypto.RSA2048, c.Acme.KeyType)
+	assert.Equal(t, lego.LEDirectoryProduction, c.Acme.Endpoint)
+	assert.True(t, c.DebugContainers)
+	assert.False(t, c.DebugHeaders)
+	assert.True(t, c.DebugHostnames)
+	assert.Equal(t, 5*time.Minute, c.ResyncInterval)
+	assert.Equal(t, []string{"/templates/partials"}, c.TemplatePartials)
+}
+
+func Test_createConfig_environmentOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+templates:
+  - source: /templates/haproxy.cfg.tpl
+    destination: /data/output/haproxy.cfg
+  - source: /templates/domains.txt.tpl
+    destination: /data/output/domains.txt
+signals:
+  - name: haproxy
+cert_uid: 100
+acme:
+  email: test@example.com
+  dns_provider: httpreq
+`)
+
+	t.Setenv(envTemplateDestinationKey, "/tmp/haproxy.cfg")
+	t.Setenv(envSignalContainerKey, "proxy")
+	t.Setenv(envSignalTypeKey, "USR1")
+	t.Setenv(envCertUserIdKey, "200")
+	t.Setenv(envDnsProviderKey, "cloudflare")
+	t.Setenv(envTemplatePartialsKey, "/partials/a.tpl, /partials/b.tpl")
+
+	c := createConfig(path)
+	assert.Equal(t, []TemplateConfig{
+		{Source: "/templates/haproxy.cfg.tpl", Destination: "/tmp/haproxy.cfg"},
+		{Source: "/templates/domains.txt.tpl", Destination: "/data/output/domains.txt"},
+	}, c.Templates)
+	assert.Equal(t, []ContainerSignal{{Name: "proxy", Signal: "USR1"}}, c.Signals)
+	assert.Equal(t, 200, c.CertUid)
+	assert.Equal(t, "cloudflare", c.Acme.DnsProvider)
+	assert.Equal(t, "test@example.com", c.Acme.Email)
+	assert.Equal(t, []string{"/partials/a.tpl", "/partials/b.tpl"}, c.TemplatePartials)
+}
+
+func Test_createConfig_resyncInterval(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+
+	t.Setenv(envResyncIntervalKey, "90s")
+	assert.Equal(t, 90*time.Second, createConfig("").ResyncInterval)
+
+	t.Setenv(envResyncIntervalKey, "0s")
+	assert.Panics(t, func() { createConfig("") })
+}
+
+func Test_createConfig_certGC(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+
+	path := writeConfigFile(t, "cert_gc: dryrun\ncert_gc_grace_period: 48h\n")
+	c := createConfig(path)
+	assert.Equal(t, CertificateGCDryRun, c.CertGC)
+	assert.Equal(t, 48*time.Hour, c.CertGCGracePeriod)
+
+	t.Setenv(envCertGCKey, "enabled")
+	t.Setenv(envCertGCGracePeriodKey, "0s")
+	c = createConfig(path)
+	assert.Equal(t, CertificateGCEnabled, c.CertGC)
+	assert.Equal(t, time.Duration(0), c.CertGCGracePeriod)
+
+	t.Setenv(envCertGCGracePeriodKey, "-1h")
+	assert.Panics(t, func() { createConfig("") })
+
+	t.Setenv(envCertGCGracePeriodKey, "1h")
+	t.Setenv(envCertGCKey, "sometimes")
+	assert.Panics(t, func() { createConfig("") })
+}
+
+func Test_createConfig_missingRequiredSetting(t *testing.T) {
+	path := writeConfigFile(t, "acme:\n  email: test@example.com\n")
+	assert.Panics(t, func() { createConfig(path) })
+}
+
+func Test_createConfig_unknownKey(t *testing.T) {
+	path := writeConfigFile(t, "certificate_deployment: disabled\ntemplate: foo\n")
+	assert.Panics(t, func() { createConfig(path) })
+}
+
+func Test_createConfig_httpChallengeDoesntRequireDnsProvider(t *testing.T) {
+	t.Setenv(envAcmeEmailKey, "test@example.com")
+	t.Setenv(envAcmeChallengeKey, AcmeChallengeHttp)
+
+	c := createConfig("")
+	assert.Equal(t, AcmeChallengeHttp, c.Acme.Challenge)
+	assert.Equal(t, "", c.Acme.DnsProvider)
+	assert.Equal(t, envAcmeHttpAddressDefault, c.Acme.HttpAddress)
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func Test_createConfig_fileVariables(t *testing.T) {
+	t.Setenv(envAcmeEmailKey+fileSuffix, writeFile(t, "email", "secret@example.com\n"))
+	t.Setenv(envDnsProviderKey+fileSuffix, writeFile(t, "provider", "httpreq"))
+	t.Setenv(envCertUserIdKey+fileSuffix, writeFile(t, "uid", "1000\n"))
+
+	c := createConfig("")
+	assert.Equal(t, "secret@example.com", c.Acme.Email)
+	assert.Equal(t, "httpreq", c.Acme.DnsProvider)
+	assert.Equal(t, 1000, c.CertUid)
+}
+
+func Test_createConfig_fileVariableConflict(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+	t.Setenv(envProxyTagKey, "public")
+	t.Setenv(envProxyTagKey+fileSuffix, writeFile(t, "tag", "private"))
+	assert.Panics(t, func() { createConfig("") })
+}
+
+func Test_createConfig_fileVariableMissing(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+	t.Setenv(envProxyTagKey+fileSuffix, filepath.Join(t.TempDir(), "missing"))
+	assert.Panics(t, func() { createConfig("") })
+}
+
+func Test_createConfig_usersFile(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+	path := writeFile(t, "users", "- name: chris\n  password: hash\n  groups: [admins]\n")
+	t.Setenv(envUsersFileKey, path)
+
+	c := createConfig("")
+	assert.Equal(t, []User{{Name: "chris", Password: "hash", Groups: []string{"admins"}}}, c.Users)
+	assert.Equal(t, path, c.UsersFile)
+}
+
+func Test_createConfig_inlineUsersConflictWithFile(t *testing.T) {
+	t.Setenv(envCertificateDeploymentKey, CertificateDeploymentDisabled)
+	t.Setenv(envUsersKey, "[]")
+	t.Setenv(envUsersFileKey, writeFile(t, "users", "[]"))
+	assert.Panics(t, func() { createConfig("") })
+}
+
+func Test_readUsersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []User
+		wantErr bool
+	}{
+		{"Empty", "", nil, false},
+		{"YAML", "- name: chris\n  password: hash\n  groups: [admins]\n- name: bob\n  password: hash2\n", []User{
+			{Name: "chris", Password: "hash", Groups: []string{"admins"}},
+			{Name: "bob", Password: "hash2"},
+		}, false},
+		{"JSON", `[{"name": "chris", "password": "hash"}]`, []User{{Name: "chris", Password: "hash"}}, false},
+		{"htpasswd", "# Users\nchris:$2y$05$abc/def\n\nbob:$apr1$xyz\n", []User{
+			{Name: "chris", Password: "$2y$05$abc/def"},
+			{Name: "bob", Password: "$apr1$xyz"},
+		}, false},
+		{"htpasswd with groups", "chris:$2y$05$abc:admins,users\n", []User{
+			{Name: "chris", Password: "$2y$05$abc", Groups: []string{"admins", "users"}},
+		}, false},
+		{"Invalid", "chris\n", nil, true},
+		{"Missing password", "chris:\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readUsersFile(writeFile(t, "users", tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_createConfig_templateValidation(t *testing.T) {
+	path := writeConfigFile(t, `
+certificate_deployment: disabled
+templates:
+  - source: /templates/haproxy.cfg.tpl
+    destination: /data/output/haproxy.cfg
+  - source: /templates/nginx.conf.tpl
+    destination: /data/output/nginx.conf
+    validate:
+      command: nginx -t -c {{file}}
+      container: nginx
+      directory: /etc/nginx
+`)
+
+	t.Setenv(envTemplateValidateCommandKey, "haproxy -c -f {{file}}")
+
+	c := createConfig(path)
+	assert.Equal(t, ValidateConfig{Command: "haproxy -c -f {{file}}"}, c.Templates[0].Validate)
+	assert.Equal(t, ValidateConfig{Command: "nginx -t -c {{file}}", Container: "nginx", Directory: "/etc/nginx"}, c.Templates[1].Validate)
+}
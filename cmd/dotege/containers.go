@@ -1,16 +1,45 @@
 package main
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	labelVhost     = "com.chameth.vhost"
+	labelProxy     = "com.chameth.proxy"
+	labelProxyTag  = "com.chameth.proxytag"
+	labelAuth      = "com.chameth.auth"
+	labelHeaders   = "com.chameth.headers"
+	labelChallenge = "com.chameth.challenge"
+	labelPath      = "com.chameth.path"
+	labelWeight    = "com.chameth.weight"
+	labelBalance   = "com.chameth.balance"
+	labelBackup    = "com.chameth.backup"
+	labelTLSALPN   = "com.chameth.tls.alpn"
+	labelTLSVerify = "com.chameth.tls.verify"
+	labelTLSCA     = "com.chameth.tls.ca"
+	labelTLSMinVer = "com.chameth.tls.minver"
 )
 
 const (
-	labelVhost    = "com.chameth.vhost"
-	labelProxy    = "com.chameth.proxy"
-	labelProxyTag = "com.chameth.proxytag"
-	labelAuth     = "com.chameth.auth"
-	labelHeaders  = "com.chameth.headers"
+	StateRunning = "running"
+
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+var (
+	balanceAlgorithms = map[string]bool{"roundrobin": true, "static-rr": true, "leastconn": true, "first": true, "source": true}
+	tlsVerifyModes    = map[string]bool{"none": true, "optional": true, "required": true}
+	tlsVersions       = map[string]bool{"SSLv3": true, "TLSv1.0": true, "TLSv1.1": true, "TLSv1.2": true, "TLSv1.3": true}
 )
 
 // Container describes a docker container that is running on the system.
@@ -19,6 +48,31 @@ type Container struct {
 	Name   string
 	Labels map[string]string
 	Ports  []int
+	// State is the docker state of the container, e.g. "created", "running", "paused" or "exited".
+	State string
+	// Health is the result of the container's health check, or empty if it doesn't have one.
+	Health string
+}
+
+// Equal determines whether the container has the same details as the other container.
+func (c *Container) Equal(other *Container) bool {
+	return c.Id == other.Id &&
+		c.Name == other.Name &&
+		c.State == other.State &&
+		c.Health == other.Health &&
+		maps.Equal(c.Labels, other.Labels) &&
+		slices.Equal(c.Ports, other.Ports)
+}
+
+// Running determines whether the container is currently running (and not paused)
+func (c *Container) Running() bool {
+	return c.State == StateRunning
+}
+
+// Healthy determines whether the container has passed its health check. Containers without a health check are
+// always considered healthy.
+func (c *Container) Healthy() bool {
+	return c.Health == "" || c.Health == HealthHealthy
 }
 
 // ShouldProxy determines whether the container should be proxied to
@@ -28,6 +82,29 @@ func (c *Container) ShouldProxy() bool {
 	return hasPort && hasVhost
 }
 
+// IgnoredReasons returns the reasons that the container won't be proxied to, if any
+func (c *Container) IgnoredReasons(requireHealthy bool) []string {
+	var reasons []string
+	if !c.Running() {
+		reasons = append(reasons, fmt.Sprintf("not running (state: %s)", c.State))
+	} else if requireHealthy && !c.Healthy() {
+		reasons = append(reasons, fmt.Sprintf("not healthy (health: %s)", c.Health))
+	}
+
+	if len(c.Vhosts()) == 0 {
+		reasons = append(reasons, "no vhost label")
+	}
+
+	if c.Port() == -1 {
+		if l, ok := c.Labels[labelProxy]; ok {
+			reasons = append(reasons, fmt.Sprintf("invalid port label: %s", l))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("no port label, and container exposes %d ports", len(c.Ports)))
+		}
+	}
+	return reasons
+}
+
 // Port returns the port the container accepts traffic on, or -1 if it could not be determined
 func (c *Container) Port() int {
 	l, ok := c.Labels[labelProxy]
@@ -54,6 +131,77 @@ func (c *Container) Port() int {
 	return -1
 }
 
+// Weight returns the load balancing weight of the container relative to others serving the same route, or -1 if
+// it is not specified
+func (c *Container) Weight() int {
+	l, ok := c.Labels[labelWeight]
+	if !ok {
+		return -1
+	}
+
+	w, err := strconv.Atoi(l)
+	if err != nil || w < 0 || w > 256 {
+		loggers.main.Warnf("Invalid weight specification on container %s: %s (must be between 0 and 256)", c.Name, l)
+		return -1
+	}
+	return w
+}
+
+// Backup determines whether the container should only receive traffic when all other containers serving the same
+// route are unavailable
+func (c *Container) Backup() bool {
+	l, ok := c.Labels[labelBackup]
+	if !ok {
+		return false
+	}
+
+	b, err := strconv.ParseBool(l)
+	if err != nil {
+		loggers.main.Warnf("Invalid backup specification on container %s: %s", c.Name, l)
+		return false
+	}
+	return b
+}
+
+// Balance returns the load balancing algorithm the container requested, or an empty string if none was specified
+func (c *Container) Balance() string {
+	l, ok := c.Labels[labelBalance]
+	if !ok {
+		return ""
+	}
+
+	if !balanceAlgorithms[l] {
+		loggers.main.Warnf("Invalid balance specification on container %s: %s", c.Name, l)
+		return ""
+	}
+	return l
+}
+
+// TLSOptions returns the TLS options requested by the container's labels. Invalid options are ignored.
+func (c *Container) TLSOptions() TLSOptions {
+	options := TLSOptions{
+		ALPN:   c.Labels[labelTLSALPN],
+		CAFile: c.Labels[labelTLSCA],
+	}
+
+	if l, ok := c.Labels[labelTLSVerify]; ok {
+		if tlsVerifyModes[l] {
+			options.Verify = l
+		} else {
+			loggers.main.Warnf("Invalid TLS verify specification on container %s: %s (must be none, optional or required)", c.Name, l)
+		}
+	}
+
+	if l, ok := c.Labels[labelTLSMinVer]; ok {
+		if tlsVersions[l] {
+			options.MinVersion = l
+		} else {
+			loggers.main.Warnf("Invalid minimum TLS version on container %s: %s (must be e.g. TLSv1.2)", c.Name, l)
+		}
+	}
+	return options
+}
+
 // Headers returns the list of headers that should be applied for this container
 func (c *Container) Headers() map[string]string {
 	res := make(map[string]string)
@@ -73,11 +221,50 @@ func (c *Container) Headers() map[string]string {
 	return res
 }
 
+// AcmeChallenge returns the type of ACME challenge that should be used to obtain certificates for this container,
+// or the fallback if the container doesn't specify a valid one.
+func (c *Container) AcmeChallenge(fallback string) string {
+	if label, ok := c.Labels[labelChallenge]; ok {
+		if label == AcmeChallengeDns || label == AcmeChallengeHttp {
+			return label
+		}
+		loggers.main.Warnf("Invalid challenge specification on container %s: %s", c.Name, label)
+	}
+	return fallback
+}
+
+// Vhosts returns the hostnames the container accepts traffic for, with any path components removed.
+func (c *Container) Vhosts() []string {
+	var names []string
+	for _, name := range splitList(c.Labels[labelVhost]) {
+		host, _, _ := strings.Cut(name, "/")
+		names = append(names, host)
+	}
+	return names
+}
+
+// Path returns the path prefix the container accepts traffic for. This is taken from the path label if present,
+// otherwise from the path component of the first vhost (e.g. "example.com/api"), and defaults to "/".
+func (c *Container) Path() string {
+	path, ok := c.Labels[labelPath]
+	if !ok {
+		if names := splitList(c.Labels[labelVhost]); len(names) > 0 {
+			_, path, _ = strings.Cut(names[0], "/")
+		}
+	}
+
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
 // CertNames returns a list of names required on a certificate for this container, taking into account wildcard
 // configuration.
 func (c *Container) CertNames(wildcards []string) []string {
-	if label, ok := c.Labels[labelVhost]; ok {
-		return applyWildcards(splitList(label), wildcards)
+	if _, ok := c.Labels[labelVhost]; ok {
+		return applyWildcards(c.Vhosts(), wildcards)
 	} else {
 		return []string{}
 	}
@@ -123,20 +310,39 @@ func wildcardMatches(wildcard, domain string) bool {
 // Containers maps container IDs to their corresponding information
 type Containers map[string]*Container
 
-// Hostnames builds a mapping of primary hostnames to details about the containers that use them
-func (c Containers) Hostnames() (hostnames map[string]*Hostname) {
+// Hostnames builds a mapping of primary hostnames to details about the containers that use them. Containers that
+// aren't running, or (if requireHealthy is set) haven't passed their health check, are excluded.
+func (c Containers) Hostnames(requireHealthy bool) (hostnames map[string]*Hostname) {
 	loggers.hostnames.Debugf("Calculating hostnames for %d containers", len(c))
 	hostnames = make(map[string]*Hostname)
+
+	// Process containers in a consistent order, so that replicas are always listed the same way and templates
+	// don't change (and trigger reloads) just because of map iteration order.
+	ordered := make([]*Container, 0, len(c))
 	for _, container := range c {
-		if label, ok := container.Labels[labelVhost]; ok {
-			names := splitList(label)
+		ordered = append(ordered, container)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Name == ordered[j].Name {
+			return ordered[i].Id < ordered[j].Id
+		}
+		return ordered[i].Name < ordered[j].Name
+	})
+
+	for _, container := range ordered {
+		if !container.Running() {
+			loggers.hostnames.Debugf("Container %s (ID: %s) is not running (state: %s)", container.Name, container.Id, container.State)
+		} else if requireHealthy && !container.Healthy() {
+			loggers.hostnames.Debugf("Container %s (ID: %s) is not healthy (health: %s)", container.Name, container.Id, container.Health)
+		} else if names := container.Vhosts(); len(names) > 0 {
 			primary := names[0]
 
 			loggers.hostnames.Debugf(
-				"Container %s (ID: %s) has vhosts: %s, port: %d, proxy status: %t",
+				"Container %s (ID: %s) has vhosts: %s, path: %s, port: %d, proxy status: %t",
 				container.Name,
 				container.Id,
-				label,
+				names,
+				container.Path(),
 				container.Port(),
 				container.ShouldProxy(),
 			)
@@ -148,7 +354,7 @@ func (c Containers) Hostnames() (hostnames map[string]*Hostname) {
 			}
 
 			h.update(names[1:], container)
-			loggers.hostnames.Debugf("Hostname %s now has %d containers and %d alternate names", h.Name, len(h.Containers), len(h.Alternatives))
+			loggers.hostnames.Debugf("Hostname %s now has %d containers, %d routes and %d alternate names", h.Name, len(h.Containers), len(h.Routes), len(h.Alternatives))
 		} else {
 			loggers.hostnames.Debugf("Container %s (ID: %s) has no vhost label", container.Name, container.Id)
 		}
@@ -161,9 +367,62 @@ type Hostname struct {
 	Name         string
 	Alternatives map[string]string
 	Containers   []*Container
+	Routes       []*Route
+	Headers      map[string]string
+	RequiresAuth bool
+	AuthGroup    string
+	Balance      string
+	// CertificateFile and KeyFile are the paths the hostname's certificate and private key have been deployed to.
+	// They're empty if certificate deployment is disabled, or the files don't exist yet. When certificates are
+	// deployed as combined files, both contain the same path.
+	CertificateFile string
+	KeyFile         string
+	// Certificate is the certificate covering the hostname and all of its alternatives, if one has been obtained.
+	// If the alternatives come from several containers, it's the certificate obtained for one of them.
+	Certificate *Certificate
+	// TLS contains the TLS options requested by the hostname's containers.
+	TLS TLSOptions
+}
+
+// TLSOptions describes how TLS connections for a hostname should be handled. Empty fields use the proxy's defaults.
+type TLSOptions struct {
+	// ALPN is a comma-separated list of protocols to offer, e.g. "h2,http/1.1".
+	ALPN string
+	// Verify is whether client certificates are verified: "none", "optional" or "required".
+	Verify string
+	// CAFile is the path to the CA certificates that client certificates are verified against.
+	CAFile string
+	// MinVersion is the minimum protocol version to accept, e.g. "TLSv1.2".
+	MinVersion string
+}
+
+// Certificate describes a certificate that has been obtained for one or more hostnames.
+type Certificate struct {
+	// Domains are the subject alternative names of the certificate. The first is the primary domain.
+	Domains []string
+	// Wildcard is the first wildcard domain (e.g. "*.example.com") the certificate was obtained for, if any. This
+	// isn't necessarily the primary domain, e.g. when a wildcard is used for a hostname's alternatives.
+	Wildcard string
+	// CertificateFile and KeyFile are the paths the certificate and private key have been deployed to, as for
+	// the equivalent Hostname fields.
+	CertificateFile string
+	KeyFile         string
+	NotBefore       time.Time
+	NotAfter        time.Time
+	// Valid indicates whether the certificate was valid when templates were generated.
+	Valid bool
+}
+
+// Route describes the containers that handle requests for a path prefix on a hostname.
+type Route struct {
+	// Name is a unique identifier for the route, containing only letters, numbers, hyphens and underscores.
+	Name         string
+	Path         string
+	Containers   []*Container
 	Headers      map[string]string
 	RequiresAuth bool
 	AuthGroup    string
+	Balance      string
 }
 
 // NewHostname creates a new hostname with the given name
@@ -183,13 +442,94 @@ func (h *Hostname) update(alternates []string, container *Container) {
 		h.Alternatives[a] = a
 	}
 
+	route := h.route(container.Path())
+	route.Containers = append(route.Containers, container)
+
 	if label, ok := container.Labels[labelAuth]; ok {
 		h.RequiresAuth = true
 		h.AuthGroup = label
+		route.RequiresAuth = true
+		route.AuthGroup = label
 	}
 
+	if balance := container.Balance(); balance != "" {
+		h.Balance = balance
+		route.Balance = balance
+	}
+
+	h.TLS.merge(container.TLSOptions())
+
 	for k, v := range container.Headers() {
 		loggers.headers.Debugf("Adding header for hostname %s: %s => %s", h.Name, k, v)
 		h.Headers[k] = v
+		route.Headers[k] = v
+	}
+}
+
+// merge updates the options with any that are set in other.
+func (o *TLSOptions) merge(other TLSOptions) {
+	if other.ALPN != "" {
+		o.ALPN = other.ALPN
+	}
+	if other.Verify != "" {
+		o.Verify = other.Verify
+	}
+	if other.CAFile != "" {
+		o.CAFile = other.CAFile
+	}
+	if other.MinVersion != "" {
+		o.MinVersion = other.MinVersion
+	}
+}
+
+// route returns the route for the given path, creating it if necessary. Routes are kept sorted with the most
+// specific (longest) paths first.
+func (h *Hostname) route(path string) *Route {
+	for _, r := range h.Routes {
+		if r.Path == path {
+			return r
+		}
+	}
+
+	name := h.Name
+	if path != "/" {
+		name += path
+	}
+
+	r := &Route{
+		Name:    identifier(name),
+		Path:    path,
+		Headers: make(map[string]string),
+	}
+	h.Routes = append(h.Routes, r)
+	sort.SliceStable(h.Routes, func(i, j int) bool {
+		if len(h.Routes[i].Path) != len(h.Routes[j].Path) {
+			return len(h.Routes[i].Path) > len(h.Routes[j].Path)
+		}
+		return h.Routes[i].Path < h.Routes[j].Path
+	})
+	return r
+}
+
+// identifier converts the given name into one containing only letters, digits, hyphens and underscores, so that it
+// can be used to name backends, routers and ACLs in any proxy's configuration. Dots become underscores to keep
+// hostnames readable, and other characters are escaped so that different names never share an identifier.
+func identifier(name string) string {
+	var res strings.Builder
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			res.WriteByte(c)
+		case c == '.':
+			res.WriteByte('_')
+		case c >= 'A' && c <= 'Z':
+			res.WriteString("_U")
+			res.WriteByte(c - 'A' + 'a')
+		case c == '/':
+			res.WriteString("_S")
+		default:
+			res.WriteString(fmt.Sprintf("_X%02X", c))
+		}
 	}
+	return res.String()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"regexp"
 	"testing"
 )
 
@@ -112,3 +113,304 @@ func TestContainer_CertNames(t *testing.T) {
 		})
 	}
 }
+
+func TestContainer_AcmeChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"No label", map[string]string{}, "fallback"},
+		{"DNS", map[string]string{labelChallenge: AcmeChallengeDns}, AcmeChallengeDns},
+		{"HTTP", map[string]string{labelChallenge: AcmeChallengeHttp}, AcmeChallengeHttp},
+		{"Invalid", map[string]string{labelChallenge: "tls-alpn"}, "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.AcmeChallenge("fallback"); got != tt.want {
+				t.Errorf("AcmeChallenge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_Path(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"No labels", map[string]string{}, "/"},
+		{"Plain vhost", map[string]string{labelVhost: "example.com"}, "/"},
+		{"Vhost with path", map[string]string{labelVhost: "example.com/api www.example.com"}, "/api"},
+		{"Path label", map[string]string{labelVhost: "example.com", labelPath: "/api"}, "/api"},
+		{"Path label without slash", map[string]string{labelVhost: "example.com", labelPath: "api"}, "/api"},
+		{"Path label overrides vhost", map[string]string{labelVhost: "example.com/foo", labelPath: "/bar"}, "/bar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.Path(); got != tt.want {
+				t.Errorf("Path() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_Vhosts(t *testing.T) {
+	c := &Container{Labels: map[string]string{labelVhost: "example.com/api, www.example.com/api example.org"}}
+	want := []string{"example.com", "www.example.com", "example.org"}
+	if got := c.Vhosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Vhosts() = %v, want %v", got, want)
+	}
+}
+
+func TestContainers_Hostnames_routes(t *testing.T) {
+	web := &Container{Id: "web", State: StateRunning, Labels: map[string]string{labelVhost: "example.com www.example.com", labelHeaders: "X-Foo: bar"}}
+	api := &Container{Id: "api", State: StateRunning, Labels: map[string]string{labelVhost: "example.com/api", labelAuth: "admins"}}
+	v2 := &Container{Id: "v2", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelPath: "/api/v2"}}
+	other := &Container{Id: "other", State: StateRunning, Labels: map[string]string{labelVhost: "example.org"}}
+
+	hostnames := Containers{"web": web, "api": api, "v2": v2, "other": other}.Hostnames(false)
+	if len(hostnames) != 2 {
+		t.Fatalf("Hostnames() returned %d hostnames, want 2", len(hostnames))
+	}
+
+	routes := hostnames["example.com"].Routes
+	var paths, names []string
+	for _, r := range routes {
+		paths = append(paths, r.Path)
+		names = append(names, r.Name)
+	}
+	if want := []string{"/api/v2", "/api", "/"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Route paths = %v, want %v", paths, want)
+	}
+	if want := []string{"example_com_Sapi_Sv2", "example_com_Sapi", "example_com"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Route names = %v, want %v", names, want)
+	}
+
+	if !reflect.DeepEqual(routes[1].Containers, []*Container{api}) || !routes[1].RequiresAuth || routes[1].AuthGroup != "admins" {
+		t.Errorf("API route = %+v, want only the api container with auth", routes[1])
+	}
+	if !reflect.DeepEqual(routes[2].Containers, []*Container{web}) || routes[2].RequiresAuth || routes[2].Headers["X-Foo"] != "bar" {
+		t.Errorf("Root route = %+v, want only the web container with headers and no auth", routes[2])
+	}
+	if len(hostnames["example.com"].Containers) != 3 {
+		t.Errorf("Hostname has %d containers, want 3", len(hostnames["example.com"].Containers))
+	}
+}
+
+func TestContainers_Hostnames_routeNames(t *testing.T) {
+	containers := Containers{
+		"a": {Id: "a", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com"}},
+		"b": {Id: "b", State: StateRunning, Labels: map[string]string{labelVhost: "foo-bar.com"}},
+		"c": {Id: "c", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com/a-b"}},
+		"d": {Id: "d", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com/a/b"}},
+		"e": {Id: "e", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com/a.b"}},
+		"f": {Id: "f", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com/A_b"}},
+		"g": {Id: "g", State: StateRunning, Labels: map[string]string{labelVhost: "foo.bar.com/a_b"}},
+	}
+
+	names := make(map[string]string)
+	for _, h := range containers.Hostnames(false) {
+		for _, r := range h.Routes {
+			if !regexp.MustCompile("^[a-zA-Z0-9_-]+$").MatchString(r.Name) {
+				t.Errorf("Route name %s for %s%s contains invalid characters", r.Name, h.Name, r.Path)
+			}
+			if other, ok := names[r.Name]; ok {
+				t.Errorf("Route name %s is used by both %s and %s%s", r.Name, other, h.Name, r.Path)
+			}
+			names[r.Name] = h.Name + r.Path
+		}
+	}
+	if len(names) != len(containers) {
+		t.Errorf("Got %d route names, want %d", len(names), len(containers))
+	}
+	if names["foo_bar_com"] != "foo.bar.com/" {
+		t.Errorf("Route name foo_bar_com is used by %q, want foo.bar.com/", names["foo_bar_com"])
+	}
+	if names["foo-bar_com"] != "foo-bar.com/" {
+		t.Errorf("Route name foo-bar_com is used by %q, want foo-bar.com/", names["foo-bar_com"])
+	}
+}
+
+func TestContainers_Hostnames_state(t *testing.T) {
+	labels := map[string]string{labelVhost: "example.com"}
+	tests := []struct {
+		name           string
+		container      Container
+		requireHealthy bool
+		want           bool
+	}{
+		{"Running", Container{State: StateRunning}, false, true},
+		{"Created", Container{State: "created"}, false, false},
+		{"Exited", Container{State: "exited"}, false, false},
+		{"Paused", Container{State: "paused"}, false, false},
+		{"Unhealthy", Container{State: StateRunning, Health: HealthUnhealthy}, false, true},
+		{"Unhealthy requiring health", Container{State: StateRunning, Health: HealthUnhealthy}, true, false},
+		{"Starting requiring health", Container{State: StateRunning, Health: HealthStarting}, true, false},
+		{"Healthy requiring health", Container{State: StateRunning, Health: HealthHealthy}, true, true},
+		{"No health check requiring health", Container{State: StateRunning}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.container
+			c.Id = "test"
+			c.Labels = labels
+			hostnames := Containers{"test": &c}.Hostnames(tt.requireHealthy)
+			if got := hostnames["example.com"] != nil; got != tt.want {
+				t.Errorf("Hostnames() included container = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_Weight(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   int
+	}{
+		{"No label", map[string]string{}, -1},
+		{"Valid", map[string]string{labelWeight: "10"}, 10},
+		{"Zero", map[string]string{labelWeight: "0"}, 0},
+		{"Too large", map[string]string{labelWeight: "257"}, -1},
+		{"Negative", map[string]string{labelWeight: "-1"}, -1},
+		{"Invalid", map[string]string{labelWeight: "heavy"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.Weight(); got != tt.want {
+				t.Errorf("Weight() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_Backup(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"No label", map[string]string{}, false},
+		{"True", map[string]string{labelBackup: "true"}, true},
+		{"False", map[string]string{labelBackup: "false"}, false},
+		{"Invalid", map[string]string{labelBackup: "maybe"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.Backup(); got != tt.want {
+				t.Errorf("Backup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_Balance(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"No label", map[string]string{}, ""},
+		{"Round robin", map[string]string{labelBalance: "roundrobin"}, "roundrobin"},
+		{"Least connections", map[string]string{labelBalance: "leastconn"}, "leastconn"},
+		{"Source", map[string]string{labelBalance: "source"}, "source"},
+		{"Invalid", map[string]string{labelBalance: "random-ish"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.Balance(); got != tt.want {
+				t.Errorf("Balance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_TLSOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   TLSOptions
+	}{
+		{"No labels", map[string]string{}, TLSOptions{}},
+		{"ALPN", map[string]string{labelTLSALPN: "h2,http/1.1"}, TLSOptions{ALPN: "h2,http/1.1"}},
+		{"Client certificates", map[string]string{labelTLSVerify: "required", labelTLSCA: "/certs/ca.pem"}, TLSOptions{Verify: "required", CAFile: "/certs/ca.pem"}},
+		{"Invalid verify", map[string]string{labelTLSVerify: "always"}, TLSOptions{}},
+		{"Minimum version", map[string]string{labelTLSMinVer: "TLSv1.2"}, TLSOptions{MinVersion: "TLSv1.2"}},
+		{"Invalid minimum version", map[string]string{labelTLSMinVer: "1.2"}, TLSOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Labels: tt.labels}
+			if got := c.TLSOptions(); got != tt.want {
+				t.Errorf("TLSOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainers_Hostnames_tlsOptions(t *testing.T) {
+	containers := Containers{
+		"a": {Id: "a", Name: "a", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelTLSALPN: "h2", labelTLSMinVer: "TLSv1.2"}},
+		"b": {Id: "b", Name: "b", State: StateRunning, Labels: map[string]string{labelVhost: "example.com/api", labelTLSMinVer: "TLSv1.3"}},
+	}
+
+	hostnames := containers.Hostnames(false)
+	want := TLSOptions{ALPN: "h2", MinVersion: "TLSv1.3"}
+	if got := hostnames["example.com"].TLS; got != want {
+		t.Errorf("TLS = %v, want %v", got, want)
+	}
+}
+
+func TestContainer_Equal(t *testing.T) {
+	base := Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}, State: StateRunning}
+	tests := []struct {
+		name  string
+		other Container
+		want  bool
+	}{
+		{"Identical", Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}, State: StateRunning}, true},
+		{"Different state", Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}, State: "exited"}, false},
+		{"Different health", Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}, State: StateRunning, Health: HealthHealthy}, false},
+		{"Different labels", Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.org"}, Ports: []int{80}, State: StateRunning}, false},
+		{"Different ports", Container{Id: "a", Name: "web", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80, 443}, State: StateRunning}, false},
+		{"Different name", Container{Id: "a", Name: "web2", Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}, State: StateRunning}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := base.Equal(&tt.other); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainer_IgnoredReasons(t *testing.T) {
+	tests := []struct {
+		name           string
+		container      Container
+		requireHealthy bool
+		want           []string
+	}{
+		{"Proxied", Container{State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80"}}, false, nil},
+		{"Single exposed port", Container{State: StateRunning, Labels: map[string]string{labelVhost: "example.com"}, Ports: []int{80}}, false, nil},
+		{"Not running", Container{State: "exited", Labels: map[string]string{labelVhost: "example.com", labelProxy: "80"}}, false, []string{"not running (state: exited)"}},
+		{"Unhealthy", Container{State: StateRunning, Health: HealthUnhealthy, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80"}}, true, []string{"not healthy (health: unhealthy)"}},
+		{"Unhealthy not required", Container{State: StateRunning, Health: HealthUnhealthy, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80"}}, false, nil},
+		{"Nothing", Container{State: StateRunning, Labels: map[string]string{}}, false, []string{"no vhost label", "no port label, and container exposes 0 ports"}},
+		{"Invalid port", Container{State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxy: "0"}}, false, []string{"invalid port label: 0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.container.IgnoredReasons(tt.requireHealthy); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("IgnoredReasons() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
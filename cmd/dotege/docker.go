@@ -2,22 +2,54 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"golang.org/x/net/context"
-	"time"
 )
 
 type DockerClient interface {
 	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
 	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
 }
 
+const (
+	// defaultMinBackoff is the initial delay before reconnecting to the Docker daemon after an error.
+	defaultMinBackoff = time.Second
+	// defaultMaxBackoff is the longest delay between attempts to reconnect to the Docker daemon.
+	defaultMaxBackoff = time.Minute
+	// defaultResyncInterval is how often the list of containers is checked for changes that were missed.
+	defaultResyncInterval = 30 * time.Second
+)
+
 type ContainerMonitor struct {
 	client DockerClient
+
+	// minBackoff and maxBackoff control how long to wait between attempts to reconnect. If zero, the defaults are
+	// used.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// resyncInterval is how often to check the list of containers for any changes we missed. If zero, the default
+	// is used.
+	resyncInterval time.Duration
+
+	// ignoreSwarmTasks skips containers that are running as tasks of a swarm service, for use when the services
+	// are being published by a ServiceMonitor.
+	ignoreSwarmTasks bool
 }
 
 type Operation int
@@ -25,6 +57,7 @@ type Operation int
 const (
 	Added = iota
 	Removed
+	Changed
 )
 
 type ContainerEvent struct {
@@ -32,94 +65,243 @@ type ContainerEvent struct {
 	Container Container
 }
 
-func (m ContainerMonitor) monitor(ctx context.Context, output chan<- ContainerEvent) error {
+// monitor publishes events about containers until the context is cancelled. If the connection to the Docker daemon
+// fails, it is retried with an exponential backoff, and all containers are resynchronised once it succeeds.
+func (m ContainerMonitor) monitor(ctx context.Context, output chan<- ContainerEvent) {
+	known := make(map[string]Container)
+	retry(ctx, "containers", m.minBackoff, m.maxBackoff, func() (bool, error) {
+		return m.watch(ctx, output, known)
+	})
+}
+
+// retry calls watch until the context is cancelled, waiting between calls with an exponential backoff. The backoff
+// is reset once watch has stayed connected for at least maxBackoff, so a daemon that accepts connections but then
+// immediately drops them isn't retried in a tight loop.
+func retry(ctx context.Context, name string, minBackoff, maxBackoff time.Duration, watch func() (bool, error)) {
+	minBackoff = durationOrDefault(minBackoff, defaultMinBackoff)
+	maxBackoff = durationOrDefault(maxBackoff, defaultMaxBackoff)
+
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		connected, err := watch()
+		if ctx.Err() != nil {
+			return
+		}
+
+		stable := connected && time.Since(start) >= maxBackoff
+		if stable {
+			backoff = minBackoff
+		}
+
+		loggers.main.Warnf("Error monitoring %s, reconnecting in %s: %s", name, backoff, err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if !stable {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// watch connects to the Docker event stream, publishes all existing containers, and then publishes events until
+// an error occurs. Returns whether the connection was successfully established, and the error that ended it.
+func (m ContainerMonitor) watch(ctx context.Context, output chan<- ContainerEvent, known map[string]Container) (bool, error) {
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	stream, errors := m.startEventStream(ctx)
-	timer := time.NewTimer(30 * time.Second)
+	ticker := time.NewTicker(durationOrDefault(m.resyncInterval, defaultResyncInterval))
+	defer ticker.Stop()
 
-	if err := m.publishExistingContainers(ctx, output); err != nil {
-		cancel()
-		return err
+	if err := m.publishExistingContainers(ctx, output, known); err != nil {
+		return false, err
 	}
 
 	for {
 		select {
 		case event := <-stream:
-			if event.Action == "create" {
-				err, container := m.inspectContainer(ctx, event.Actor.ID)
-				if err != nil {
-					cancel()
-					return err
-				}
-				output <- ContainerEvent{
-					Operation: Added,
-					Container: container,
-				}
-			} else {
-				output <- ContainerEvent{
+			if event.Action == "destroy" {
+				delete(known, event.Actor.ID)
+				send(ctx, output, ContainerEvent{
 					Operation: Removed,
 					Container: Container{
 						Id: event.Actor.ID,
 					},
+				})
+			} else {
+				err, container := m.inspectContainer(ctx, event.Actor.ID)
+				if err != nil && client.IsErrNotFound(err) {
+					// The container has already been removed; we'll get a destroy event shortly.
+					loggers.main.Debugf("Container %s was removed before it could be inspected", event.Actor.ID)
+					continue
+				} else if err != nil {
+					return true, err
 				}
+
+				if m.ignored(container) {
+					loggers.containers.Debugf("Ignoring container %s as it is a swarm task", container.Name)
+					continue
+				}
+				publishContainer(ctx, output, known, container)
 			}
 
 		case err := <-errors:
-			cancel()
-			return err
+			return true, err
 
-		case <- timer.C:
-			if err := m.publishExistingContainers(ctx, output); err != nil {
-				cancel()
-				return err
+		case <-ticker.C:
+			if err := m.publishExistingContainers(ctx, output, known); err != nil {
+				return true, err
 			}
 
 		case <-ctx.Done():
-			return nil
+			return true, ctx.Err()
+		}
+	}
+}
+
+// publishContainer sends an Added or Changed event for the container if it's new or differs from the known version.
+func publishContainer(ctx context.Context, output chan<- ContainerEvent, known map[string]Container, container Container) {
+	previous, ok := known[container.Id]
+	if ok && previous.Equal(&container) {
+		loggers.containers.Debugf("Container %s has not changed", container.Name)
+		return
+	}
+
+	known[container.Id] = container
+	operation := Operation(Added)
+	if ok {
+		operation = Changed
+	}
+	send(ctx, output, ContainerEvent{
+		Operation: operation,
+		Container: container,
+	})
+}
+
+// publishAll compares the given containers with the known containers, and sends Added, Changed and Removed events
+// for any differences.
+func publishAll(ctx context.Context, output chan<- ContainerEvent, known map[string]Container, containers []Container) {
+	existing := make(map[string]bool)
+	for _, container := range containers {
+		existing[container.Id] = true
+		publishContainer(ctx, output, known, container)
+	}
+
+	for id := range known {
+		if !existing[id] {
+			loggers.main.Debugf("Container %s was removed while not monitoring", id)
+			delete(known, id)
+			send(ctx, output, ContainerEvent{
+				Operation: Removed,
+				Container: Container{
+					Id: id,
+				},
+			})
 		}
 	}
 }
 
+// send publishes the event unless the context is cancelled first.
+func send(ctx context.Context, output chan<- ContainerEvent, event ContainerEvent) {
+	select {
+	case output <- event:
+	case <-ctx.Done():
+	}
+}
+
 func (m ContainerMonitor) startEventStream(ctx context.Context) (<-chan events.Message, <-chan error) {
 	args := filters.NewArgs()
 	args.Add("type", "container")
-	args.Add("event", "create")
-	args.Add("event", "destroy")
+	for _, event := range []string{"create", "start", "die", "stop", "pause", "unpause", "health_status", "destroy"} {
+		args.Add("event", event)
+	}
 	return m.client.Events(ctx, types.EventsOptions{Filters: args})
 }
 
-func (m ContainerMonitor) publishExistingContainers(ctx context.Context, output chan<- ContainerEvent) error {
+// publishExistingContainers compares the containers that currently exist with the known containers, and sends
+// Added, Changed and Removed events for any differences.
+func (m ContainerMonitor) publishExistingContainers(ctx context.Context, output chan<- ContainerEvent, known map[string]Container) error {
 	containers, err := m.client.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
 		return fmt.Errorf("unable to list containers: %s", err.Error())
 	}
 
+	var current []Container
 	for _, container := range containers {
-		output <- ContainerEvent{
-			Operation: Added,
-			Container: Container{
-				Id:     container.ID,
-				Name:   container.Names[0][1:],
-				Labels: container.Labels,
-				Ports:  portsFromContainerPorts(container.Ports),
-			},
+		c := Container{
+			Id:     container.ID,
+			Name:   container.Names[0][1:],
+			Labels: container.Labels,
+			Ports:  portsFromContainerPorts(container.Ports),
+			State:  container.State,
+			Health: healthFromStatus(container.Status),
+		}
+		if !m.ignored(c) {
+			current = append(current, c)
 		}
 	}
+
+	publishAll(ctx, output, known, current)
 	return nil
 }
 
+// ignored returns true if the container shouldn't be published at all.
+func (m ContainerMonitor) ignored(container Container) bool {
+	_, isTask := container.Labels[labelSwarmServiceId]
+	return m.ignoreSwarmTasks && isTask
+}
+
 func (m ContainerMonitor) inspectContainer(ctx context.Context, id string) (error, Container) {
 	container, err := m.client.ContainerInspect(ctx, id)
 	if err != nil {
 		return err, Container{}
 	}
 
+	var health string
+	if container.State.Health != nil {
+		health = container.State.Health.Status
+	}
+
+	var ports []int
+	if container.NetworkSettings != nil {
+		ports = portsFromContainerPortMap(container.NetworkSettings.Ports)
+	}
+
 	return nil, Container{
 		Id:     container.ID,
 		Name:   container.Name[1:],
 		Labels: container.Config.Labels,
-		Ports:  portsFromContainerPortMap(container.HostConfig.PortBindings),
+		Ports:  ports,
+		State:  container.State.Status,
+		Health: health,
+	}
+}
+
+// durationOrDefault returns the given duration, or the fallback if it is zero.
+func durationOrDefault(duration, fallback time.Duration) time.Duration {
+	if duration == 0 {
+		return fallback
+	}
+	return duration
+}
+
+// healthFromStatus extracts the health of a container from its human-readable status (e.g. "Up 2 hours (healthy)")
+func healthFromStatus(status string) string {
+	if strings.HasSuffix(status, "(health: starting)") {
+		return HealthStarting
+	} else if strings.HasSuffix(status, "(unhealthy)") {
+		return HealthUnhealthy
+	} else if strings.HasSuffix(status, "(healthy)") {
+		return HealthHealthy
 	}
+	return ""
 }
 
 // portsFromContainerPortMap collates all non-exposed TCP ports from the given map
@@ -129,6 +311,7 @@ func portsFromContainerPortMap(ps nat.PortMap) (ports []int) {
 			ports = append(ports, p.Int())
 		}
 	}
+	sort.Ints(ports)
 	return
 }
 
@@ -139,5 +322,6 @@ func portsFromContainerPorts(ps []types.Port) (ports []int) {
 			ports = append(ports, int(p.PrivatePort))
 		}
 	}
+	sort.Ints(ports)
 	return
 }
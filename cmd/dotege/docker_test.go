@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDockerClient implements DockerClient using canned data.
+type fakeDockerClient struct {
+	mutex      sync.Mutex
+	events     chan events.Message
+	errors     chan error
+	containers []types.Container
+	inspect    map[string]types.ContainerJSON
+	listErr    error
+	services   []swarm.Service
+
+	// exec handles commands run with docker exec, returning their output and exit code.
+	exec     func(container string, cmd []string) (string, int)
+	execs    map[string]fakeExec
+	execRuns int
+
+	// kills records the signals sent to containers, in the form "id:signal".
+	kills []string
+}
+
+type fakeExec struct {
+	output string
+	code   int
+}
+
+func newFakeDockerClient() *fakeDockerClient {
+	return &fakeDockerClient{
+		events:  make(chan events.Message),
+		errors:  make(chan error),
+		inspect: make(map[string]types.ContainerJSON),
+		execs:   make(map[string]fakeExec),
+	}
+}
+
+func (f *fakeDockerClient) Events(context.Context, types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return f.events, f.errors
+}
+
+func (f *fakeDockerClient) ContainerList(context.Context, types.ContainerListOptions) ([]types.Container, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return append([]types.Container(nil), f.containers...), nil
+}
+
+func (f *fakeDockerClient) ServiceList(_ context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+
+	var services []swarm.Service
+	for _, s := range f.services {
+		if options.Filters.Len() == 0 || options.Filters.ExactMatch("id", s.ID) {
+			services = append(services, s)
+		}
+	}
+	return services, nil
+}
+
+func (f *fakeDockerClient) ContainerInspect(_ context.Context, id string) (types.ContainerJSON, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if c, ok := f.inspect[id]; ok {
+		return c, nil
+	}
+	return types.ContainerJSON{}, errdefs.NotFound(assert.AnError)
+}
+
+func (f *fakeDockerClient) ContainerKill(_ context.Context, id, signal string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.kills = append(f.kills, id+":"+signal)
+	return nil
+}
+
+func (f *fakeDockerClient) signalsSent() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.kills...)
+}
+
+func (f *fakeDockerClient) ContainerExecCreate(_ context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.exec == nil {
+		return types.IDResponse{}, errdefs.NotFound(assert.AnError)
+	}
+
+	f.execRuns++
+	id := fmt.Sprintf("exec%d", f.execRuns)
+	output, code := f.exec(container, config.Cmd)
+	f.execs[id] = fakeExec{output: output, code: code}
+	return types.IDResponse{ID: id}, nil
+}
+
+func (f *fakeDockerClient) ContainerExecAttach(_ context.Context, execID string, _ types.ExecStartCheck) (types.HijackedResponse, error) {
+	f.mutex.Lock()
+	output := f.execs[execID].output
+	f.mutex.Unlock()
+
+	server, conn := net.Pipe()
+	go func() {
+		_, _ = stdcopy.NewStdWriter(server, stdcopy.Stderr).Write([]byte(output))
+		_ = server.Close()
+	}()
+	return types.NewHijackedResponse(conn, ""), nil
+}
+
+func (f *fakeDockerClient) ContainerExecInspect(_ context.Context, execID string) (types.ContainerExecInspect, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e, ok := f.execs[execID]
+	if !ok {
+		return types.ContainerExecInspect{}, errdefs.NotFound(assert.AnError)
+	}
+	return types.ContainerExecInspect{ExecID: execID, ExitCode: e.code}, nil
+}
+
+func (f *fakeDockerClient) setInspect(id, name, state, health string, labels map[string]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			State:      &types.ContainerState{Status: state},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Labels: labels},
+	}
+	if health != "" {
+		c.State.Health = &types.Health{Status: health}
+	}
+	f.inspect[id] = c
+}
+
+func receiveEvent(t *testing.T, events <-chan ContainerEvent) ContainerEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for container event")
+		return ContainerEvent{}
+	}
+}
+
+func Test_ContainerMonitor_stateEvents(t *testing.T) {
+	client := newFakeDockerClient()
+	client.containers = []types.Container{
+		{ID: "existing", Names: []string{"/existing"}, State: StateRunning, Status: "Up 2 hours (healthy)"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client}.monitor(ctx, output)
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "existing", event.Container.Name)
+	assert.Equal(t, StateRunning, event.Container.State)
+	assert.Equal(t, HealthHealthy, event.Container.Health)
+
+	client.setInspect("new", "new", "created", "", nil)
+	client.events <- events.Message{Action: "create", Actor: events.Actor{ID: "new"}}
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "created", event.Container.State)
+
+	client.setInspect("new", "new", StateRunning, HealthStarting, nil)
+	client.events <- events.Message{Action: "start", Actor: events.Actor{ID: "new"}}
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Changed), event.Operation)
+	assert.Equal(t, StateRunning, event.Container.State)
+	assert.Equal(t, HealthStarting, event.Container.Health)
+
+	client.setInspect("new", "new", StateRunning, HealthHealthy, nil)
+	client.events <- events.Message{Action: "health_status: healthy", Actor: events.Actor{ID: "new"}}
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Changed), event.Operation)
+	assert.Equal(t, HealthHealthy, event.Container.Health)
+
+	// A container that's gone by the time we inspect it should be skipped, not kill the monitor
+	client.events <- events.Message{Action: "die", Actor: events.Actor{ID: "vanished"}}
+	client.events <- events.Message{Action: "destroy", Actor: events.Actor{ID: "new"}}
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Removed), event.Operation)
+	assert.Equal(t, "new", event.Container.Id)
+}
+
+func Test_ContainerMonitor_reconnects(t *testing.T) {
+	client := newFakeDockerClient()
+	client.containers = []types.Container{
+		{ID: "a", Names: []string{"/a"}, State: StateRunning},
+		{ID: "b", Names: []string{"/b"}, State: StateRunning},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, minBackoff: time.Millisecond}.monitor(ctx, output)
+
+	assert.Equal(t, "a", receiveEvent(t, output).Container.Id)
+	assert.Equal(t, "b", receiveEvent(t, output).Container.Id)
+
+	client.mutex.Lock()
+	client.containers = []types.Container{
+		{ID: "a", Names: []string{"/a"}, State: StateRunning},
+		{ID: "c", Names: []string{"/c"}, State: StateRunning},
+	}
+	client.mutex.Unlock()
+	client.errors <- errors.New("connection reset")
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "c", event.Container.Id)
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Removed), event.Operation)
+	assert.Equal(t, "b", event.Container.Id)
+}
+
+func Test_ContainerMonitor_resync(t *testing.T) {
+	client := newFakeDockerClient()
+	client.containers = []types.Container{
+		{ID: "a", Names: []string{"/a"}, State: StateRunning, Labels: map[string]string{labelVhost: "a.example.com"}},
+		{ID: "b", Names: []string{"/b"}, State: StateRunning, Status: "Up 2 hours (healthy)"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, resyncInterval: 10 * time.Millisecond}.monitor(ctx, output)
+
+	assert.Equal(t, "a", receiveEvent(t, output).Container.Id)
+	assert.Equal(t, "b", receiveEvent(t, output).Container.Id)
+
+	// Nothing has changed, so resyncing shouldn't publish anything
+	select {
+	case event := <-output:
+		require.FailNow(t, "Unexpected event", "%v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.mutex.Lock()
+	client.containers = []types.Container{
+		{ID: "b", Names: []string{"/b"}, State: StateRunning, Status: "Up 2 hours (unhealthy)"},
+		{ID: "c", Names: []string{"/c"}, State: StateRunning},
+	}
+	client.mutex.Unlock()
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Changed), event.Operation)
+	assert.Equal(t, "b", event.Container.Id)
+	assert.Equal(t, HealthUnhealthy, event.Container.Health)
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "c", event.Container.Id)
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Removed), event.Operation)
+	assert.Equal(t, "a", event.Container.Id)
+}
+
+func Test_ContainerMonitor_retriesUntilConnected(t *testing.T) {
+	client := newFakeDockerClient()
+	client.listErr = errors.New("daemon not running")
+	client.containers = []types.Container{{ID: "a", Names: []string{"/a"}, State: StateRunning}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, minBackoff: time.Millisecond, maxBackoff: 5 * time.Millisecond}.monitor(ctx, output)
+
+	select {
+	case <-output:
+		require.FailNow(t, "Received event while daemon was unavailable")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.mutex.Lock()
+	client.listErr = nil
+	client.mutex.Unlock()
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "a", event.Container.Id)
+}
+
+func Test_retry_backsOffWhenConnectionDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The connection succeeds but is dropped straight away, so the backoff should keep growing
+	var calls []time.Time
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		retry(ctx, "test", time.Millisecond, time.Minute, func() (bool, error) {
+			calls = append(calls, time.Now())
+			if len(calls) == 6 {
+				cancel()
+			}
+			return true, errors.New("stream closed")
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for retries")
+	}
+
+	require.Len(t, calls, 6)
+	assert.GreaterOrEqual(t, calls[5].Sub(calls[0]), (1+2+4+8+16)*time.Millisecond)
+}
+
+func Test_ContainerMonitor_inspectError(t *testing.T) {
+	client := newFakeDockerClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, minBackoff: time.Millisecond}.monitor(ctx, output)
+
+	// Containers that are removed before they can be inspected are skipped, even if we only saw them being created
+	client.events <- events.Message{Action: "create", Actor: events.Actor{ID: "short-lived"}}
+
+	client.setInspect("new", "new", StateRunning, "", nil)
+	client.events <- events.Message{Action: "start", Actor: events.Actor{ID: "new"}}
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "new", event.Container.Id)
+}
+
+func Test_ContainerMonitor_ignoreSwarmTasks(t *testing.T) {
+	client := newFakeDockerClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, ignoreSwarmTasks: true}.monitor(ctx, output)
+
+	client.setInspect("task", "web.1.abc", StateRunning, "", map[string]string{labelSwarmServiceId: "s1"})
+	client.events <- events.Message{Action: "start", Actor: events.Actor{ID: "task"}}
+
+	client.setInspect("new", "new", StateRunning, "", nil)
+	client.events <- events.Message{Action: "start", Actor: events.Actor{ID: "new"}}
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "new", event.Container.Id)
+}
+
+func Test_healthFromStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"Up 2 hours", ""},
+		{"Up 2 hours (healthy)", HealthHealthy},
+		{"Up 2 hours (unhealthy)", HealthUnhealthy},
+		{"Up 2 seconds (health: starting)", HealthStarting},
+		{"Exited (0) 5 minutes ago", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.want, healthFromStatus(tt.status))
+		})
+	}
+}
@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/signal"
-	"path"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/docker/docker/client"
 	"go.uber.org/zap"
@@ -30,9 +27,10 @@ var (
 		containers: zap.NewNop().Sugar(),
 	}
 
-	config     *Config
-	containers = make(Containers)
-	GitSHA     string
+	config *Config
+	GitSHA string
+
+	configPath = flag.String("config", "", "Path to a YAML config file. Environment variables override values in the file.")
 )
 
 func monitorSignals() <-chan bool {
@@ -61,16 +59,23 @@ func createLogger() *zap.SugaredLogger {
 	return logger.Sugar()
 }
 
-func createTemplates(configs []TemplateConfig) Templates {
+func createTemplates(configs []TemplateConfig, partials []string, client DockerClient) Templates {
 	var templates Templates
-	for _, t := range configs {
-		templates = append(templates, CreateTemplate(t.Source, t.Destination))
+	for _, c := range configs {
+		expanded, err := expandTemplateConfig(c)
+		if err != nil {
+			panic(fmt.Errorf("unable to find templates for %s: %w", c.Source, err))
+		}
+
+		for _, t := range expanded {
+			templates = append(templates, CreateTemplate(t.Source, t.Destination, partials, t.Signals, NewValidator(t.Validate, client)))
+		}
 	}
 	return templates
 }
 
 func createCertificateManager(config AcmeConfig) *CertificateManager {
-	cm := NewCertificateManager(loggers.main, config.Endpoint, config.KeyType, config.DnsProvider, config.CacheLocation)
+	cm := NewCertificateManager(loggers.main, config.Endpoint, config.KeyType, config.DnsProvider, config.HttpAddress, config.CacheLocation)
 	err := cm.Init(config.Email)
 	if err != nil {
 		panic(err)
@@ -79,10 +84,11 @@ func createCertificateManager(config AcmeConfig) *CertificateManager {
 }
 
 func main() {
+	flag.Parse()
 	loggers.main.Infof("Dotege %s is starting", GitSHA)
 
 	doneChan := monitorSignals()
-	config = createConfig()
+	config = createConfig(*configPath)
 
 	setUpDebugLoggers()
 
@@ -93,105 +99,53 @@ func main() {
 		panic(err)
 	}
 
-	templates := createTemplates(config.Templates)
+	templates := createTemplates(config.Templates, config.TemplatePartials, dockerClient)
 	var certificateManager *CertificateManager
 
 	if config.CertificateDeployment != CertificateDeploymentDisabled {
 		certificateManager = createCertificateManager(config.Acme)
 	}
 
-	containerMonitor := ContainerMonitor{client: dockerClient}
+	var haproxy *HAProxyRuntimeAPI
+	if config.HAProxy.Socket != "" {
+		haproxy = NewHAProxyRuntimeAPI(config.HAProxy.Socket)
+	}
+
+	statusAPI := NewStatusAPI(templates, certificateManager, config.ProxyTag, config.RequireHealthy)
+	if config.ListenAddress != "" {
+		startHTTPServer(config.ListenAddress, statusAPI)
+	}
 
-	jitterTimer := time.NewTimer(time.Minute)
-	redeployTimer := time.NewTicker(time.Hour * 24)
-	updatedContainers := make(map[string]*Container)
+	containerMonitor := ContainerMonitor{client: dockerClient, resyncInterval: config.ResyncInterval, ignoreSwarmTasks: config.Swarm}
 	containerEvents := make(chan ContainerEvent)
+	userUpdates := make(chan []User)
 
-	go func() {
-		if err := containerMonitor.monitor(ctx, containerEvents); err != nil {
-			loggers.main.Fatal("Error monitoring containers: ", err.Error())
+	if config.UsersFile != "" {
+		if err := watchUsersFile(ctx, config.UsersFile, userUpdates); err != nil {
+			panic(fmt.Errorf("unable to watch users file %s: %w", config.UsersFile, err))
 		}
-	}()
+	}
 
-	go func() {
-		for {
-			select {
-			case event := <-containerEvents:
-				switch event.Operation {
-				case Added:
-					if event.Container.Labels[labelProxyTag] == config.ProxyTag {
-						loggers.main.Debugf("Container added: %s", event.Container.Name)
-						loggers.containers.Debugf("New container with name %s has id: %s", event.Container.Name, event.Container.Id)
-						containers[event.Container.Id] = &event.Container
-						updatedContainers[event.Container.Id] = &event.Container
-						jitterTimer.Reset(100 * time.Millisecond)
-					} else {
-						loggers.main.Debugf("Container ignored due to proxy tag: %s (wanted: '%s', got: '%s')", event.Container.Name, config.ProxyTag, event.Container.Labels[labelProxyTag])
-					}
-				case Removed:
-					loggers.main.Debugf("Container removed: %s", event.Container.Id)
-
-					_, inUpdated := updatedContainers[event.Container.Id]
-					_, inExisting := containers[event.Container.Id]
-					loggers.containers.Debugf(
-						"Removed container with ID %s, was in updated containers: %t, main containers: %t",
-						event.Container.Id,
-						inUpdated,
-						inExisting,
-					)
-
-					delete(updatedContainers, event.Container.Id)
-					delete(containers, event.Container.Id)
-					jitterTimer.Reset(100 * time.Millisecond)
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+	go containerMonitor.monitor(ctx, containerEvents)
 
-	go func() {
-		for {
-			select {
-			case <-jitterTimer.C:
-				loggers.containers.Debugf("Processing updated containers: %v", updatedContainers)
-				updated := templates.Generate(struct {
-					Containers map[string]*Container
-					Hostnames  map[string]*Hostname
-					Groups     []string
-					Users      []User
-				}{
-					containers,
-					containers.Hostnames(),
-					groups(config.Users),
-					config.Users,
-				})
-
-				for name, container := range updatedContainers {
-					certDeployed := deployCertForContainer(certificateManager, container)
-					updated = updated || certDeployed
-					delete(updatedContainers, name)
-				}
-
-				if updated {
-					signalContainer(dockerClient)
-				}
-			case <-redeployTimer.C:
-				loggers.main.Info("Performing periodic certificate refresh")
-				updated := false
-
-				for _, container := range containers {
-					if deployCertForContainer(certificateManager, container) {
-						updated = true
-					}
-				}
-
-				if updated {
-					signalContainer(dockerClient)
-				}
-			}
+	if config.Swarm {
+		serviceMonitor := ServiceMonitor{client: dockerClient, resyncInterval: config.ResyncInterval}
+		go serviceMonitor.monitor(ctx, containerEvents)
+	}
+
+	if config.StaticRoutesFile != "" {
+		if err := watchStaticRoutes(ctx, config.StaticRoutesFile, config.ProxyTag, containerEvents); err != nil {
+			panic(fmt.Errorf("unable to read static routes file %s: %w", config.StaticRoutesFile, err))
 		}
-	}()
+	}
+
+	templateChanges := make(chan *Template)
+	if err := templates.Watch(ctx, templateChanges); err != nil {
+		panic(err)
+	}
+
+	reconciler := NewReconciler(config, dockerClient, templates, certificateManager, haproxy, statusAPI)
+	go reconciler.Run(ctx, containerEvents, userUpdates, templateChanges)
 
 	<-doneChan
 
@@ -202,6 +156,23 @@ func main() {
 	}
 }
 
+// watchUsersFile re-reads the users file whenever it changes, and sends the new users to the given channel.
+func watchUsersFile(ctx context.Context, path string, updates chan<- []User) error {
+	return watchFile(ctx, path, func() {
+		users, err := readUsersFile(path)
+		if err != nil {
+			loggers.main.Errorf("Unable to reload users file %s, keeping existing users: %v", path, err)
+			return
+		}
+
+		loggers.main.Infof("Users file %s changed, loaded %d users", path, len(users))
+		select {
+		case updates <- users:
+		case <-ctx.Done():
+		}
+	})
+}
+
 func setUpDebugLoggers() {
 	if config.DebugContainers {
 		loggers.containers = loggers.main
@@ -216,118 +187,30 @@ func setUpDebugLoggers() {
 	}
 }
 
-func signalContainer(dockerClient *client.Client) {
-	for _, s := range config.Signals {
-		var container *Container
-		for _, c := range containers {
-			if c.Name == s.Name {
-				container = c
-			}
-		}
-
-		if container != nil {
-			loggers.main.Debugf("Killing container %s (%s) with signal %s", container.Name, container.Id, s.Signal)
-			err := dockerClient.ContainerKill(context.Background(), container.Id, s.Signal)
-			if err != nil {
-				loggers.main.Errorf("Unable to send signal %s to container %s: %s", s.Signal, s.Name, err.Error())
-			}
-		} else {
-			loggers.main.Warnf("Couldn't signal container %s as it is not running", s.Name)
-		}
-	}
-}
-
-func deployCertForContainer(cm *CertificateManager, container *Container) bool {
-	if config.CertificateDeployment == CertificateDeploymentDisabled {
-		return false
-	}
-
-	hostnames := container.CertNames(config.WildCardDomains)
-	if len(hostnames) == 0 {
-		loggers.main.Debugf("No labels found for container %s", container.Name)
-		return false
-	}
-
-	cert, err := cm.GetCertificate(hostnames)
-	if err != nil {
-		loggers.main.Warnf("Unable to generate certificate for %s: %s", container.Name, err.Error())
-		return false
-	} else if config.CertificateDeployment == CertificateDeploymentSplit {
-		return deploySplitCert(cert)
-	} else {
-		return deployCombinedCert(cert)
-	}
+// certificateFileName returns the name of the file the certificate for the given primary domain should be deployed
+// to, with the given extension.
+func certificateFileName(domain, extension string) string {
+	return fmt.Sprintf("%s.%s", strings.ReplaceAll(domain, "*", "_"), extension)
 }
 
-func deploySplitCert(certificate *SavedCertificate) bool {
-	name := fmt.Sprintf("%s.pem", strings.ReplaceAll(certificate.Domains[0], "*", "_"))
-	target := path.Join(config.DefaultCertDestination, name)
-
-	buf, _ := ioutil.ReadFile(target)
-	if bytes.Equal(buf, certificate.Certificate) {
-		loggers.main.Debugf("Certificate was up to date: %s", target)
-		return false
-	}
-
-	err := ioutil.WriteFile(target, certificate.Certificate, config.CertMode)
-	if err != nil {
-		loggers.main.Warnf("Unable to write certificate %s - %s", target, err.Error())
-		return false
-	}
-
-	if err = os.Chown(target, config.CertUid, config.CertGid); err != nil {
-		loggers.main.Warnf("Unable to chown certificate %s - %s", target, err.Error())
-		return false
-	}
-
-	name = fmt.Sprintf("%s.key", strings.ReplaceAll(certificate.Domains[0], "*", "_"))
-	target = path.Join(config.DefaultCertDestination, name)
-
-	buf, _ = ioutil.ReadFile(target)
-	if bytes.Equal(buf, certificate.PrivateKey) {
-		loggers.main.Debugf("Key was up to date: %s", target)
-		return false
-	}
-
-	err = ioutil.WriteFile(target, certificate.PrivateKey, config.CertMode)
-	if err != nil {
-		loggers.main.Warnf("Unable to write key %s - %s", target, err.Error())
-		return false
-	}
-
-	if err = os.Chown(target, config.CertUid, config.CertGid); err != nil {
-		loggers.main.Warnf("Unable to chown key %s - %s", target, err.Error())
-		return false
-	}
-
-	loggers.main.Infof("Updated certificate file %s", target)
-	return true
+// certificateBaseName returns the name, without an extension, of the files a certificate with the given primary
+// domain is deployed to.
+func certificateBaseName(domain string) string {
+	return strings.TrimSuffix(certificateFileName(domain, "pem"), ".pem")
 }
 
-func deployCombinedCert(certificate *SavedCertificate) bool {
-	name := fmt.Sprintf("%s.pem", strings.ReplaceAll(certificate.Domains[0], "*", "_"))
-	target := path.Join(config.DefaultCertDestination, name)
-	content := append(certificate.Certificate, certificate.PrivateKey...)
-
-	buf, _ := ioutil.ReadFile(target)
-	if bytes.Equal(buf, content) {
-		loggers.main.Debugf("Certificate was up to date: %s", target)
-		return false
-	}
-
-	err := ioutil.WriteFile(target, content, config.CertMode)
-	if err != nil {
-		loggers.main.Warnf("Unable to write certificate %s - %s", target, err.Error())
-		return false
-	}
-
-	if err := os.Chown(target, config.CertUid, config.CertGid); err != nil {
-		loggers.main.Warnf("Unable to chown certificate %s - %s", target, err.Error())
-		return false
+// updateContainerMetrics records the number of known containers and hostnames.
+func updateContainerMetrics(containers Containers, hostnames map[string]*Hostname) {
+	proxied := 0
+	for _, c := range containers {
+		if c.ShouldProxy() {
+			proxied++
+		}
 	}
 
-	loggers.main.Infof("Updated certificate file %s", target)
-	return true
+	metrics.containers.Set(float64(len(containers)))
+	metrics.proxiedContainers.Set(float64(proxied))
+	metrics.hostnames.Set(float64(len(hostnames)))
 }
 
 func groups(users []User) []string {
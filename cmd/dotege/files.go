@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// stagingDirName is the name of the directory that versions of files written by writeFilesAtomic are kept in.
+const stagingDirName = ".dotege"
+
+// writeFileAtomic writes the content to a temporary file in the same directory as path, and then renames it over
+// path so that readers never see a partially written file. If check is non-nil it is called with the path of the
+// temporary file before it is renamed; if it returns an error the existing file is left untouched.
+func writeFileAtomic(path string, content []byte, perm os.FileMode, check func(temp string) error) error {
+	temp, err := writeTempFile(path, content, perm)
+	if err != nil {
+		return err
+	}
+
+	if check != nil {
+		if err := check(temp); err != nil {
+			_ = os.Remove(temp)
+			return err
+		}
+	}
+
+	if err := os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes the content to a new hidden file alongside the given path, returning the name of the new file.
+// Unlike os.CreateTemp, the given permissions are used (subject to the umask).
+func writeTempFile(path string, content []byte, perm os.FileMode) (string, error) {
+	dir, base := filepath.Split(path)
+	for i := 0; i < 100; i++ {
+		temp := filepath.Join(dir, fmt.Sprintf(".%s.tmp-%d", base, rand.Uint32()))
+		f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		_, err = f.Write(content)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(temp)
+			return "", err
+		}
+		return temp, nil
+	}
+	return "", fmt.Errorf("unable to create temporary file for %s", path)
+}
+
+// writeFilesAtomic writes a set of related files (such as a certificate and its private key) to dir so that they all
+// change at once. Each version of the files is written to a new directory under the staging directory, and a
+// "<name>.current" symlink is then switched to point at it. The files in dir itself are symlinks through the current
+// link, so they always refer to the same version. If writing the new version fails the previous one is kept.
+func writeFilesAtomic(dir, name string, files map[string][]byte, perm os.FileMode, uid, gid int) error {
+	var names []string
+	for f := range files {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	stagingDir := filepath.Join(dir, stagingDirName)
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return err
+	}
+
+	version := fmt.Sprintf("%s-%s", name, filesVersion(names, files))
+	versionDir := filepath.Join(stagingDir, version)
+	if err := os.RemoveAll(versionDir); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		return err
+	}
+
+	for _, f := range names {
+		err := writeFileAtomic(filepath.Join(versionDir, f), files[f], perm, func(temp string) error {
+			return os.Chown(temp, uid, gid)
+		})
+		if err != nil {
+			_ = os.RemoveAll(versionDir)
+			return err
+		}
+	}
+
+	current := filepath.Join(stagingDir, name+".current")
+	previous, _ := os.Readlink(current)
+	if err := replaceSymlink(version, current); err != nil {
+		if previous != version {
+			_ = os.RemoveAll(versionDir)
+		}
+		return err
+	}
+
+	for _, f := range names {
+		target := filepath.Join(stagingDirName, name+".current", f)
+		link := filepath.Join(dir, f)
+		if existing, _ := os.Readlink(link); existing == target {
+			continue
+		}
+
+		if err := replaceSymlink(target, link); err != nil {
+			return err
+		}
+	}
+
+	removeOldVersions(stagingDir, name, version, previous)
+	return nil
+}
+
+// filesVersion returns a short identifier derived from the names and contents of the given files.
+func filesVersion(names []string, files map[string][]byte) string {
+	hash := sha256.New()
+	for _, f := range names {
+		_, _ = fmt.Fprintf(hash, "%s:%d:", f, len(files[f]))
+		_, _ = hash.Write(files[f])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// removeOldVersions deletes any versions of the named files in the staging directory other than those given. The
+// previous version is kept so that anything still reading it isn't disrupted.
+func removeOldVersions(stagingDir, name string, keep ...string) {
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		return
+	}
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(name) + "-[0-9a-f]{16}$")
+	for _, e := range entries {
+		if e.IsDir() && pattern.MatchString(e.Name()) && !slices.Contains(keep, e.Name()) {
+			if err := os.RemoveAll(filepath.Join(stagingDir, e.Name())); err != nil {
+				loggers.main.Warnf("Unable to remove old version %s: %s", e.Name(), err.Error())
+			}
+		}
+	}
+}
+
+// replaceSymlink atomically creates or replaces the symlink at path so that it points to target.
+func replaceSymlink(target, path string) error {
+	dir, base := filepath.Split(path)
+	temp := filepath.Join(dir, fmt.Sprintf(".%s.tmp-%d", base, rand.Uint32()))
+	if err := os.Symlink(target, temp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// fileExists determines whether a regular file (or a symlink to one) exists at the given path.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
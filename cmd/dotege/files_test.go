@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+func dirEntries(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+
+	require.NoError(t, writeFileAtomic(path, []byte("one"), 0640, nil))
+	assert.Equal(t, "one", readFile(t, path))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm()&0640)
+
+	require.NoError(t, writeFileAtomic(path, []byte("two"), 0640, nil))
+	assert.Equal(t, "two", readFile(t, path))
+	assert.Equal(t, []string{"file"}, dirEntries(t, dir))
+}
+
+func Test_writeFileAtomic_checkFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(path, []byte("original"), 0600))
+
+	var checked string
+	err := writeFileAtomic(path, []byte("new"), 0600, func(temp string) error {
+		checked = readFile(t, temp)
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, "new", checked)
+	assert.Equal(t, "original", readFile(t, path))
+	assert.Equal(t, []string{"file"}, dirEntries(t, dir))
+}
+
+func Test_writeFileAtomic_renameFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, os.MkdirAll(filepath.Join(path, "child"), 0755))
+
+	assert.Error(t, writeFileAtomic(path, []byte("new"), 0600, nil))
+	assert.Equal(t, []string{"file"}, dirEntries(t, dir))
+}
+
+func Test_writeFilesAtomic(t *testing.T) {
+	dir := t.TempDir()
+	write := func(cert, key string) {
+		require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{
+			"example.com.pem": []byte(cert),
+			"example.com.key": []byte(key),
+		}, 0600, -1, -1))
+		assert.Equal(t, cert, readFile(t, filepath.Join(dir, "example.com.pem")))
+		assert.Equal(t, key, readFile(t, filepath.Join(dir, "example.com.key")))
+	}
+
+	write("cert1", "key1")
+	assert.Equal(t, []string{stagingDirName, "example.com.key", "example.com.pem"}, dirEntries(t, dir))
+
+	link, err := os.Readlink(filepath.Join(dir, "example.com.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(stagingDirName, "example.com.current", "example.com.pem"), link)
+
+	first, err := os.Readlink(filepath.Join(dir, stagingDirName, "example.com.current"))
+	require.NoError(t, err)
+
+	// Writing the same content again doesn't create a new version
+	write("cert1", "key1")
+	assert.Len(t, dirEntries(t, filepath.Join(dir, stagingDirName)), 2)
+
+	// The previous version is kept after an update
+	write("cert2", "key2")
+	assert.Len(t, dirEntries(t, filepath.Join(dir, stagingDirName)), 3)
+	assert.DirExists(t, filepath.Join(dir, stagingDirName, first))
+
+	// But older versions are removed
+	write("cert3", "key3")
+	assert.Len(t, dirEntries(t, filepath.Join(dir, stagingDirName)), 3)
+	assert.NoDirExists(t, filepath.Join(dir, stagingDirName, first))
+}
+
+func Test_writeFilesAtomic_leavesOtherNamesAlone(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{"example.com.pem": []byte("a")}, 0600, -1, -1))
+	require.NoError(t, writeFilesAtomic(dir, "example.com-foo", map[string][]byte{"example.com-foo.pem": []byte("b")}, 0600, -1, -1))
+	require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{"example.com.pem": []byte("c")}, 0600, -1, -1))
+	require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{"example.com.pem": []byte("d")}, 0600, -1, -1))
+
+	assert.Equal(t, "b", readFile(t, filepath.Join(dir, "example.com-foo.pem")))
+	assert.Equal(t, "d", readFile(t, filepath.Join(dir, "example.com.pem")))
+}
+
+func Test_writeFilesAtomic_replacesRegularFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.pem"), []byte("old cert"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.key"), []byte("old key"), 0600))
+
+	require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{
+		"example.com.pem": []byte("cert"),
+		"example.com.key": []byte("key"),
+	}, 0600, -1, -1))
+	assert.Equal(t, "cert", readFile(t, filepath.Join(dir, "example.com.pem")))
+	assert.Equal(t, "key", readFile(t, filepath.Join(dir, "example.com.key")))
+}
+
+func Test_writeFilesAtomic_stagingFails(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, writeFilesAtomic(dir, "example.com", map[string][]byte{
+		"example.com.pem": []byte("cert1"),
+		"example.com.key": []byte("key1"),
+	}, 0600, -1, -1))
+
+	// The second file can't be written, so the new version should be abandoned
+	err := writeFilesAtomic(dir, "example.com", map[string][]byte{
+		"example.com.pem":         []byte("cert2"),
+		"missing/example.com.key": []byte("key2"),
+	}, 0600, -1, -1)
+	assert.Error(t, err)
+
+	assert.Equal(t, "cert1", readFile(t, filepath.Join(dir, "example.com.pem")))
+	assert.Equal(t, "key1", readFile(t, filepath.Join(dir, "example.com.key")))
+	assert.Len(t, dirEntries(t, filepath.Join(dir, stagingDirName)), 2)
+}
+
+func Test_writeFilesAtomic_linkFails(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "example.com.key", "child"), 0755))
+
+	err := writeFilesAtomic(dir, "example.com", map[string][]byte{
+		"example.com.pem": []byte("cert"),
+		"example.com.key": []byte("key"),
+	}, 0600, -1, -1)
+	assert.Error(t, err)
+
+	// No temporary links should be left behind
+	for _, name := range dirEntries(t, dir) {
+		assert.Contains(t, []string{stagingDirName, "example.com.key", "example.com.pem"}, name)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateFuncs are the functions available to templates. Where a function takes an input to operate on, it's
+// the last argument so that it can be used in a pipeline.
+var templateFuncs = template.FuncMap{
+	"replace": func(from, to, input string) string { return strings.Replace(input, from, to, -1) },
+	"split":   func(sep, input string) []string { return strings.Split(input, sep) },
+	"join":    func(sep string, input []string) string { return strings.Join(input, sep) },
+	"sortlines": func(input string) string {
+		lines := strings.Split(input, "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	},
+
+	"default":    defaultValue,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"hasPrefix":  func(prefix, input string) bool { return strings.HasPrefix(input, prefix) },
+	"hasSuffix":  func(suffix, input string) bool { return strings.HasSuffix(input, suffix) },
+	"trimPrefix": func(prefix, input string) string { return strings.TrimPrefix(input, prefix) },
+	"trimSuffix": func(suffix, input string) string { return strings.TrimSuffix(input, suffix) },
+	"trim":       strings.TrimSpace,
+	"base":       path.Base,
+	"identifier": identifier,
+	"contains":   contains,
+	"sortedKeys": sortedKeys,
+	"uniq":       uniq,
+
+	"toJson":       toJson,
+	"toYaml":       toYaml,
+	"quote":        quote,
+	"yamlQuote":    yamlQuote,
+	"haproxyQuote": haproxyQuote,
+
+	"env":   os.Getenv,
+	"label": label,
+
+	"regexMatch":   regexMatch,
+	"regexReplace": regexReplace,
+
+	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	"mul": func(a, b int) int { return a * b },
+	"div": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	},
+	"mod": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a % b, nil
+	},
+}
+
+// defaultValue returns the value, or the fallback if the value is empty (nil, zero, or an empty string, slice or
+// map).
+func defaultValue(fallback, value interface{}) interface{} {
+	if isEmpty(value) {
+		return fallback
+	}
+	return value
+}
+
+// isEmpty determines whether the value is nil, the zero value of its type, or an empty slice or map.
+func isEmpty(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return true
+	}
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// contains determines whether the input contains the item. Strings are checked for a substring, slices for a
+// matching element, and maps for a matching key.
+func contains(item, input interface{}) (bool, error) {
+	v := reflect.ValueOf(input)
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("can't check if a string contains %T", item)
+		}
+		return strings.Contains(v.String(), s), nil
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if reflect.DeepEqual(v.Index(i).Interface(), item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		key := reflect.ValueOf(item)
+		if !key.IsValid() || !key.Type().AssignableTo(v.Type().Key()) {
+			return false, nil
+		}
+		return v.MapIndex(key).IsValid(), nil
+	default:
+		return false, fmt.Errorf("can't check if %T contains a value", input)
+	}
+}
+
+// sortedKeys returns the keys of a map with string keys, in alphabetical order.
+func sortedKeys(input interface{}) ([]string, error) {
+	v := reflect.ValueOf(input)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("can't get sorted keys of %T", input)
+	}
+
+	var keys []string
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// uniq returns the input with any duplicate values removed, keeping the first occurrence of each.
+func uniq(input []string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, s := range input {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func toJson(input interface{}) (string, error) {
+	buf, err := json.Marshal(input)
+	return string(buf), err
+}
+
+func toYaml(input interface{}) (string, error) {
+	buf, err := yaml.Marshal(input)
+	return strings.TrimSuffix(string(buf), "\n"), err
+}
+
+// quote surrounds the input with double quotes, escaping any backslashes or double quotes it contains. Line
+// breaks are removed, as they can't appear in a single configuration directive. The output is suitable for use in
+// nginx config files.
+func quote(input string) string {
+	return `"` + quoteReplacer.Replace(input) + `"`
+}
+
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", "")
+
+// haproxyQuote is like quote, but also escapes dollar signs so haproxy doesn't treat them as environment variables.
+func haproxyQuote(input string) string {
+	return `"` + haproxyQuoteReplacer.Replace(input) + `"`
+}
+
+var haproxyQuoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\r", "", "\n", "")
+
+// yamlQuote surrounds the input with double quotes, escaping it so that it's always treated as a string by YAML
+// parsers regardless of its content.
+func yamlQuote(input string) string {
+	// JSON strings are valid double-quoted YAML scalars.
+	builder := &strings.Builder{}
+	encoder := json.NewEncoder(builder)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(input)
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// label returns the value of the container's label with the given name, or the fallback if it's not set.
+func label(name, fallback string, container *Container) string {
+	if container != nil {
+		if value, ok := container.Labels[name]; ok {
+			return value
+		}
+	}
+	return fallback
+}
+
+func regexMatch(pattern, input string) (bool, error) {
+	return regexp.MatchString(pattern, input)
+}
+
+// regexReplace replaces all matches of the pattern in the input. The replacement may refer to submatches using
+// "$1" or "${name}".
+func regexReplace(pattern, replacement, input string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(input, replacement), nil
+}
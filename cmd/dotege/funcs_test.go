@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func executeTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("test").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	builder := &strings.Builder{}
+	err = tmpl.Execute(builder, data)
+	return builder.String(), err
+}
+
+func Test_templateFuncs(t *testing.T) {
+	container := &Container{Labels: map[string]string{labelVhost: "example.com", labelProxy: "8080"}}
+	t.Setenv("DOTEGE_TEST_VAR", "from env")
+
+	tests := []struct {
+		name     string
+		template string
+		data     interface{}
+		want     string
+		wantErr  bool
+	}{
+		{"replace", `{{ "a.b.c" | replace "." "_" }}`, nil, "a_b_c", false},
+		{"split and join", `{{ "a b c" | split " " | join "," }}`, nil, "a,b,c", false},
+		{"sortlines", `{{ "b\na\nc" | sortlines }}`, nil, "a\nb\nc", false},
+
+		{"default with value", `{{ . | default "fallback" }}`, "value", "value", false},
+		{"default with empty string", `{{ . | default "fallback" }}`, "", "fallback", false},
+		{"default with nil", `{{ . | default "fallback" }}`, nil, "fallback", false},
+		{"default with zero", `{{ . | default 80 }}`, 0, "80", false},
+		{"default with empty slice", `{{ . | default "fallback" }}`, []string{}, "fallback", false},
+		{"default with empty map", `{{ . | default "fallback" }}`, map[string]string{}, "fallback", false},
+
+		{"lower", `{{ "MiXeD" | lower }}`, nil, "mixed", false},
+		{"upper", `{{ "MiXeD" | upper }}`, nil, "MIXED", false},
+		{"hasPrefix", `{{ "/api/v1" | hasPrefix "/api" }} {{ "/web" | hasPrefix "/api" }}`, nil, "true false", false},
+		{"hasSuffix", `{{ "example.com" | hasSuffix ".com" }} {{ "example.org" | hasSuffix ".com" }}`, nil, "true false", false},
+		{"trimPrefix", `{{ "www.example.com" | trimPrefix "www." }}`, nil, "example.com", false},
+		{"trimSuffix", `{{ "haproxy.cfg.tpl" | trimSuffix ".tpl" }}`, nil, "haproxy.cfg", false},
+		{"trim", `{{ "  padded  " | trim }}`, nil, "padded", false},
+		{"base", `{{ "/data/certs/example.com.pem" | base }}`, nil, "example.com.pem", false},
+		{"identifier", `{{ "my-site.example.com/api" | identifier }}`, nil, "my-site_example_com_Sapi", false},
+
+		{"contains substring", `{{ "example.com" | contains "ample" }}`, nil, "true", false},
+		{"contains element", `{{ . | contains "b" }} {{ . | contains "d" }}`, []string{"a", "b", "c"}, "true false", false},
+		{"contains key", `{{ . | contains "b" }} {{ . | contains "d" }}`, map[string]bool{"a": true, "b": false}, "true false", false},
+		{"contains on int", `{{ . | contains "b" }}`, 1, "", true},
+
+		{"sortedKeys", `{{ range sortedKeys . }}{{ . }} {{ end }}`, map[string]int{"c": 1, "a": 2, "b": 3}, "a b c ", false},
+		{"sortedKeys on non-map", `{{ sortedKeys . }}`, []string{"a"}, "", true},
+		{"uniq", `{{ . | uniq | join "," }}`, []string{"b", "a", "b", "c", "a"}, "b,a,c", false},
+
+		{"toJson", `{{ toJson . }}`, map[string]interface{}{"name": "web", "ports": []int{80, 443}}, `{"name":"web","ports":[80,443]}`, false},
+		{"toYaml", `{{ toYaml . }}`, map[string]interface{}{"name": "web", "ports": []int{80, 443}}, "name: web\nports:\n- 80\n- 443", false},
+		{"quote", `{{ quote . }}`, "say \"hi\" \\ $HOME\n", `"say \"hi\" \\ $HOME"`, false},
+		{"yamlQuote", `{{ yamlQuote . }}`, "yes: <\"hi\">\n", `"yes: <\"hi\">\n"`, false},
+		{"haproxyQuote", `{{ haproxyQuote . }}`, "say \"hi\" \\ $HOME\n", `"say \"hi\" \\ \$HOME"`, false},
+
+		{"env", `{{ env "DOTEGE_TEST_VAR" }}`, nil, "from env", false},
+		{"env unset", `{{ env "DOTEGE_TEST_UNSET_VAR" | default "unset" }}`, nil, "unset", false},
+		{"label", `{{ label "com.chameth.vhost" "none" . }}`, container, "example.com", false},
+		{"label with fallback", `{{ . | label "com.chameth.auth" "none" }}`, container, "none", false},
+
+		{"regexMatch", `{{ regexMatch "^[a-z]+\\.com$" "example.com" }} {{ regexMatch "^[a-z]+$" "example.com" }}`, nil, "true false", false},
+		{"regexMatch invalid", `{{ regexMatch "(" "example.com" }}`, nil, "", true},
+		{"regexReplace", `{{ "www.example.com" | regexReplace "^www\\.(.*)$" "$1" }}`, nil, "example.com", false},
+		{"regexReplace invalid", `{{ "example.com" | regexReplace "(" "" }}`, nil, "", true},
+
+		{"add", `{{ 8080 | add 1 }}`, nil, "8081", false},
+		{"sub", `{{ sub 10 3 }}`, nil, "7", false},
+		{"mul", `{{ mul 6 7 }}`, nil, "42", false},
+		{"div", `{{ div 7 2 }}`, nil, "3", false},
+		{"div by zero", `{{ div 7 0 }}`, nil, "", true},
+		{"mod", `{{ mod 7 2 }}`, nil, "1", false},
+		{"mod by zero", `{{ mod 7 0 }}`, nil, "", true},
+		{"arithmetic on container fields", `{{ .Port | add 1 }}`, container, "8081", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeTemplate(tt.template, tt.data)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// collectGarbage removes certificates that are no longer needed by any container from the cache, once they've
+// expired or haven't been needed for the configured grace period. Their deployed files are removed at the same
+// time, unless they're still in use, as are any other certificate files in the destination that no certificate
+// needs and that haven't changed for the grace period. In dry-run mode the changes are only logged. Returns true
+// if any deployed files were removed, and the proxy needs to be signalled to stop using them.
+func (r *Reconciler) collectGarbage() bool {
+	if r.config.CertGC == CertificateGCDisabled || r.certificates == nil {
+		return false
+	}
+
+	dryRun := r.config.CertGC == CertificateGCDryRun
+	var used [][]string
+	keep := make(map[string]bool)
+	for _, container := range r.containers {
+		if names := container.CertNames(r.config.WildCardDomains); len(names) > 0 {
+			used = append(used, names)
+			keep[certificateBaseName(names[0])] = true
+		}
+	}
+
+	if err := r.certificates.MarkUsed(used); err != nil {
+		loggers.main.Warnf("Unable to save certificate usage: %s", err.Error())
+	}
+
+	cutoff := time.Now().Add(-r.config.CertGCGracePeriod)
+	stale, current := r.certificates.StaleCertificates(cutoff)
+
+	// Several certificates may be deployed to the same files if they share a primary domain.
+	for _, cert := range current {
+		keep[certificateBaseName(cert.Domains[0])] = true
+	}
+
+	unused := make(map[string]bool)
+	for _, cert := range stale {
+		if name := certificateBaseName(cert.Domains[0]); !keep[name] {
+			unused[name] = true
+		}
+		if dryRun {
+			loggers.main.Infof("Would remove certificate for %s from cache (dry run)", cert.Domains)
+		}
+	}
+
+	for _, name := range r.orphanedCertificates(keep, cutoff) {
+		unused[name] = true
+	}
+
+	removed := false
+	for name := range unused {
+		if dryRun {
+			loggers.main.Infof("Would remove deployed files for %s (dry run)", name)
+		} else {
+			removed = r.removeDeployedCertificate(name) || removed
+		}
+	}
+
+	if !dryRun && len(stale) > 0 {
+		if err := r.certificates.RemoveCertificates(stale); err != nil {
+			loggers.main.Warnf("Unable to save certificate cache after removing certificates: %s", err.Error())
+		}
+	}
+	return removed
+}
+
+// orphanedCertificates returns the base names of certificate and key files in the certificate destination that
+// aren't in keep and haven't been modified since the cutoff. These are typically left behind by certificates that
+// were removed from the cache by something other than the garbage collector.
+func (r *Reconciler) orphanedCertificates(keep map[string]bool, cutoff time.Time) []string {
+	if r.config.CertificateDeployment == CertificateDeploymentDisabled {
+		return nil
+	}
+
+	entries, err := os.ReadDir(r.config.DefaultCertDestination)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			loggers.main.Warnf("Unable to list certificate destination: %s", err.Error())
+		}
+		return nil
+	}
+
+	var res []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".pem" && ext != ".key") {
+			continue
+		}
+
+		name := strings.TrimSuffix(e.Name(), ext)
+		if keep[name] {
+			continue
+		}
+
+		if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// removeDeployedCertificate removes the certificate and key files with the given base name from the certificate
+// destination, along with any versions of them kept by writeFilesAtomic. Returns true if anything was removed.
+func (r *Reconciler) removeDeployedCertificate(name string) bool {
+	dir := r.config.DefaultCertDestination
+	stagingDir := filepath.Join(dir, stagingDirName)
+
+	removed := false
+	for _, file := range []string{
+		filepath.Join(dir, name+".pem"),
+		filepath.Join(dir, name+".key"),
+		filepath.Join(stagingDir, name+".current"),
+	} {
+		if err := os.Remove(file); err == nil {
+			loggers.main.Infof("Removed unused certificate file %s", file)
+			removed = true
+		} else if !os.IsNotExist(err) {
+			loggers.main.Warnf("Unable to remove unused certificate file %s: %s", file, err.Error())
+		}
+	}
+
+	removeOldVersions(stagingDir, name)
+	return removed
+}
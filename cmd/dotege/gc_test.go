@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGarbageCollector creates a reconciler with a container using example.com, and certificates for:
+//   - example.com, which is in use
+//   - old.example.com, which hasn't been used for longer than the grace period
+//   - recent.example.com, which isn't used but is still within the grace period
+//   - expired.example.com, which has expired
+//
+// All certificates are deployed to dir using split keys.
+func newTestGarbageCollector(t *testing.T, mode string) (*Reconciler, *CertificateManager, string) {
+	dir := t.TempDir()
+	now := time.Now()
+	expiry := now.Add(time.Hour * 24 * 60)
+
+	certs := []*SavedCertificate{
+		{Domains: []string{"example.com"}, NotAfter: expiry, LastUsed: now.Add(-time.Hour * 24 * 30)},
+		{Domains: []string{"old.example.com"}, NotAfter: expiry, LastUsed: now.Add(-time.Hour * 24 * 8)},
+		{Domains: []string{"recent.example.com"}, NotAfter: expiry, LastUsed: now.Add(-time.Hour * 24)},
+		{Domains: []string{"expired.example.com"}, NotAfter: now.Add(-time.Hour), LastUsed: now},
+	}
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", filepath.Join(t.TempDir(), "certs.json"))
+	cm.data = &CertificateManagerData{Certs: certs}
+
+	config := &Config{
+		CertificateDeployment:  CertificateDeploymentSplit,
+		DefaultCertDestination: dir,
+		CertMode:               0600,
+		CertUid:                -1,
+		CertGid:                -1,
+		CertGC:                 mode,
+		CertGCGracePeriod:      time.Hour * 24 * 7,
+	}
+
+	reconciler := NewReconciler(config, nil, nil, cm, nil, nil)
+	reconciler.containers["web"] = &Container{Id: "web", Name: "web", State: StateRunning, Labels: map[string]string{labelVhost: "example.com"}}
+
+	for _, cert := range certs {
+		cert.Certificate = []byte("cert for " + cert.Domains[0])
+		cert.PrivateKey = []byte("key for " + cert.Domains[0])
+		require.True(t, reconciler.deploySplitCert(cert))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "crt-list.txt"), nil, 0600))
+	return reconciler, cm, dir
+}
+
+func Test_Reconciler_collectGarbage(t *testing.T) {
+	reconciler, cm, dir := newTestGarbageCollector(t, CertificateGCEnabled)
+
+	assert.True(t, reconciler.collectGarbage())
+
+	var domains []string
+	for _, cert := range cm.data.Certs {
+		domains = append(domains, cert.Domains[0])
+	}
+	assert.Equal(t, []string{"example.com", "recent.example.com"}, domains)
+	assert.WithinDuration(t, time.Now(), cm.data.Certs[0].LastUsed, time.Minute)
+
+	for _, name := range []string{"example.com.pem", "example.com.key", "recent.example.com.pem", "recent.example.com.key", "crt-list.txt"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+	for _, name := range []string{"old.example.com", "expired.example.com"} {
+		assert.NoFileExists(t, filepath.Join(dir, name+".pem"))
+		assert.NoFileExists(t, filepath.Join(dir, name+".key"))
+
+		versions, err := filepath.Glob(filepath.Join(dir, stagingDirName, name+"*"))
+		require.NoError(t, err)
+		assert.Empty(t, versions)
+	}
+
+	// The cache file reflects the removals
+	saved := NewCertificateManager(loggers.main, "", "", "", "", cm.path)
+	require.NoError(t, saved.load())
+	assert.Len(t, saved.data.Certs, 2)
+
+	// Nothing else to remove
+	assert.False(t, reconciler.collectGarbage())
+}
+
+func Test_Reconciler_collectGarbage_keepsSharedFiles(t *testing.T) {
+	reconciler, cm, dir := newTestGarbageCollector(t, CertificateGCEnabled)
+
+	// An old certificate for the same primary domain as one in use is removed from the cache, but the files are
+	// still needed.
+	cm.data.Certs = append(cm.data.Certs, &SavedCertificate{
+		Domains:  []string{"example.com", "www.example.com"},
+		NotAfter: time.Now().Add(time.Hour),
+		LastUsed: time.Now().Add(-time.Hour * 24 * 30),
+	})
+
+	reconciler.collectGarbage()
+	assert.Len(t, cm.data.Certs, 2)
+	assert.FileExists(t, filepath.Join(dir, "example.com.pem"))
+	assert.FileExists(t, filepath.Join(dir, "example.com.key"))
+}
+
+func Test_Reconciler_collectGarbage_dryRun(t *testing.T) {
+	reconciler, cm, dir := newTestGarbageCollector(t, CertificateGCDryRun)
+
+	assert.False(t, reconciler.collectGarbage())
+	assert.Len(t, cm.data.Certs, 4)
+	for _, name := range []string{"example.com", "old.example.com", "recent.example.com", "expired.example.com"} {
+		assert.FileExists(t, filepath.Join(dir, name+".pem"))
+		assert.FileExists(t, filepath.Join(dir, name+".key"))
+	}
+}
+
+// writeOrphanedFiles writes files to dir that aren't related to any cached certificate, and returns the names of
+// those that should be removed by the garbage collector.
+func writeOrphanedFiles(t *testing.T, dir string) []string {
+	old := time.Now().Add(-time.Hour * 24 * 8)
+	for name, modified := range map[string]time.Time{
+		"orphan.example.com.pem": old,
+		"orphan.example.com.key": old,
+		"new.example.com.pem":    time.Now(),
+		"notes.txt":              old,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), modified, modified))
+	}
+	return []string{"orphan.example.com.pem", "orphan.example.com.key"}
+}
+
+func Test_Reconciler_collectGarbage_orphanedFiles(t *testing.T) {
+	reconciler, _, dir := newTestGarbageCollector(t, CertificateGCEnabled)
+	orphans := writeOrphanedFiles(t, dir)
+
+	assert.True(t, reconciler.collectGarbage())
+	for _, name := range orphans {
+		assert.NoFileExists(t, filepath.Join(dir, name))
+	}
+	for _, name := range []string{"new.example.com.pem", "notes.txt", "example.com.pem", "recent.example.com.pem"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+
+	// Orphans are removed even when there's nothing stale in the cache
+	orphans = writeOrphanedFiles(t, dir)
+	assert.True(t, reconciler.collectGarbage())
+	for _, name := range orphans {
+		assert.NoFileExists(t, filepath.Join(dir, name))
+	}
+}
+
+func Test_Reconciler_collectGarbage_orphanedFilesDryRun(t *testing.T) {
+	reconciler, _, dir := newTestGarbageCollector(t, CertificateGCDryRun)
+	orphans := writeOrphanedFiles(t, dir)
+
+	assert.False(t, reconciler.collectGarbage())
+	for _, name := range orphans {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+}
+
+func Test_Reconciler_collectsGarbageAtStartup(t *testing.T) {
+	reconciler, _, dir := newTestGarbageCollector(t, CertificateGCEnabled)
+	removed := append(writeOrphanedFiles(t, dir), "old.example.com.pem", "expired.example.com.pem")
+	reconciler.status = NewStatusAPI(nil, nil, "", false)
+	reconciler.startupDelay = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reconciler.Run(ctx, make(chan ContainerEvent), make(chan []User), make(chan *Template))
+
+	assert.Eventually(t, func() bool {
+		for _, name := range removed {
+			if fileExists(filepath.Join(dir, name)) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(dir, "example.com.pem"))
+}
+
+func Test_Reconciler_collectGarbage_disabled(t *testing.T) {
+	reconciler, cm, _ := newTestGarbageCollector(t, CertificateGCDisabled)
+
+	assert.False(t, reconciler.collectGarbage())
+	assert.Len(t, cm.data.Certs, 4)
+}
+
+func Test_Reconciler_redeploy_regeneratesTemplates(t *testing.T) {
+	reconciler, _, dir := newTestGarbageCollector(t, CertificateGCEnabled)
+
+	client := newFakeDockerClient()
+	source := filepath.Join(t.TempDir(), "certs.tpl")
+	output := filepath.Join(t.TempDir(), "certs")
+	require.NoError(t, os.WriteFile(source, []byte("{{ range .Certificates }}{{ index .Domains 0 }} {{ .CertificateFile }}\n{{ end }}"), 0600))
+
+	reconciler.client = client
+	reconciler.config.Signals = []ContainerSignal{{Name: "proxy", Signal: "HUP"}}
+	reconciler.templates = Templates{CreateTemplate(source, output, nil, []ContainerSignal{{Name: "proxy", Signal: "USR2"}}, nil)}
+	reconciler.containers["proxy"] = &Container{Id: "proxy", Name: "proxy", State: StateRunning}
+
+	reconciler.redeploy()
+
+	buf, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com "+filepath.Join(dir, "example.com.pem")+"\n", string(buf))
+	assert.Equal(t, []string{"proxy:USR2", "proxy:HUP"}, client.signalsSent())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const haproxyTimeout = 10 * time.Second
+
+// HAProxyRuntimeAPI communicates with a running HAProxy instance over its runtime API (stats socket), allowing
+// certificates to be updated without reloading the whole process.
+type HAProxyRuntimeAPI struct {
+	network string
+	address string
+}
+
+// NewHAProxyRuntimeAPI creates a new runtime API client for the given socket address. The address may be prefixed
+// with "unix:" or "tcp:"; otherwise anything containing a "/" is assumed to be a unix socket.
+func NewHAProxyRuntimeAPI(address string) *HAProxyRuntimeAPI {
+	if strings.HasPrefix(address, "unix:") {
+		return &HAProxyRuntimeAPI{network: "unix", address: strings.TrimPrefix(address, "unix:")}
+	} else if strings.HasPrefix(address, "tcp:") {
+		return &HAProxyRuntimeAPI{network: "tcp", address: strings.TrimPrefix(address, "tcp:")}
+	} else if strings.Contains(address, "/") {
+		return &HAProxyRuntimeAPI{network: "unix", address: address}
+	} else {
+		return &HAProxyRuntimeAPI{network: "tcp", address: address}
+	}
+}
+
+// UpdateCertificate replaces the contents of the named certificate in HAProxy's memory. If HAProxy doesn't know
+// about the certificate yet, it is created and added to the given crt-list (which may also be a directory that
+// was passed to a "crt" bind option). If creating a new certificate fails part way through, it is deleted again
+// so that the next attempt starts from scratch.
+func (h *HAProxyRuntimeAPI) UpdateCertificate(name string, content []byte, crtList string) error {
+	existing, err := h.certificates()
+	if err != nil {
+		return err
+	}
+
+	isNew := !existing[name]
+	if isNew {
+		if err := h.expect(fmt.Sprintf("new ssl cert %s", name), "New empty certificate store"); err != nil {
+			return err
+		}
+	}
+
+	if err := h.setCertificate(name, content); err != nil {
+		if isNew {
+			h.deleteCertificate(name)
+		}
+		return err
+	}
+
+	if isNew {
+		if err := h.expect(fmt.Sprintf("add ssl crt-list %s %s", crtList, name), "Success!"); err != nil {
+			h.deleteCertificate(name)
+			return err
+		}
+	}
+	return nil
+}
+
+// setCertificate updates the content of the named certificate in a single transaction, aborting it on failure.
+func (h *HAProxyRuntimeAPI) setCertificate(name string, content []byte) error {
+	payload := fmt.Sprintf("set ssl cert %s <<\n%s\n\n", name, stripBlankLines(content))
+	if err := h.expect(payload, "Transaction created", "Transaction updated"); err != nil {
+		_, _ = h.execute(fmt.Sprintf("abort ssl cert %s", name))
+		return err
+	}
+
+	if err := h.expect(fmt.Sprintf("commit ssl cert %s", name), "Success!"); err != nil {
+		_, _ = h.execute(fmt.Sprintf("abort ssl cert %s", name))
+		return err
+	}
+	return nil
+}
+
+// deleteCertificate removes the named certificate from HAProxy's memory. Failures are only logged, as this is
+// used to clean up after another error.
+func (h *HAProxyRuntimeAPI) deleteCertificate(name string) {
+	if err := h.expect(fmt.Sprintf("del ssl cert %s", name), "deleted"); err != nil {
+		loggers.main.Warnf("Unable to remove incomplete certificate %s from haproxy: %s", name, err.Error())
+	}
+}
+
+// certificates returns the names of all certificates currently loaded by HAProxy.
+func (h *HAProxyRuntimeAPI) certificates() (map[string]bool, error) {
+	response, err := h.execute("show ssl cert")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]bool)
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "*") {
+			res[line] = true
+		}
+	}
+	return res, nil
+}
+
+// expect executes the given command, and returns an error if the response doesn't contain any of the given values.
+func (h *HAProxyRuntimeAPI) expect(command string, values ...string) error {
+	response, err := h.execute(command)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if strings.Contains(response, v) {
+			return nil
+		}
+	}
+
+	command, _, _ = strings.Cut(command, "\n")
+	return fmt.Errorf("unexpected response to '%s': %s", command, strings.TrimSpace(response))
+}
+
+// execute sends a single command to HAProxy and returns its response.
+func (h *HAProxyRuntimeAPI) execute(command string) (string, error) {
+	conn, err := net.DialTimeout(h.network, h.address, haproxyTimeout)
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to haproxy runtime API: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(haproxyTimeout)); err != nil {
+		return "", err
+	}
+
+	if !strings.HasSuffix(command, "\n") {
+		command += "\n"
+	}
+
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return "", fmt.Errorf("unable to send command to haproxy runtime API: %w", err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("unable to read response from haproxy runtime API: %w", err)
+	}
+	return string(response), nil
+}
+
+// stripBlankLines removes any empty lines from the given content, as HAProxy treats them as the end of a payload.
+func stripBlankLines(content []byte) string {
+	var res []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); len(line) > 0 {
+			res = append(res, line)
+		}
+	}
+	return strings.Join(res, "\n")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHAProxy implements enough of the HAProxy runtime API to test certificate updates.
+type fakeHAProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	certs    map[string]string
+	pending  map[string]string
+	crtLists map[string][]string
+	commands []string
+	failSet  bool
+	failAdd  bool
+}
+
+func newFakeHAProxy(t *testing.T, certs ...string) *fakeHAProxy {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "haproxy.sock"))
+	require.NoError(t, err)
+
+	f := &fakeHAProxy{
+		listener: listener,
+		certs:    make(map[string]string),
+		pending:  make(map[string]string),
+		crtLists: make(map[string][]string),
+	}
+	for _, c := range certs {
+		f.certs[c] = "original"
+	}
+
+	go f.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return f
+}
+
+func (f *fakeHAProxy) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+		command, _ := reader.ReadString('\n')
+		command = strings.TrimSpace(command)
+
+		var payload []string
+		if strings.HasSuffix(command, "<<") {
+			command = strings.TrimSpace(strings.TrimSuffix(command, "<<"))
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || strings.TrimSpace(line) == "" {
+					break
+				}
+				payload = append(payload, strings.TrimSpace(line))
+			}
+		}
+
+		_, _ = conn.Write([]byte(f.handle(command, strings.Join(payload, "\n"))))
+		_ = conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(command, payload string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commands = append(f.commands, command)
+	args := strings.Fields(command)
+	switch {
+	case command == "show ssl cert":
+		res := "# filename\n"
+		for name := range f.certs {
+			res += name + "\n"
+		}
+		return res + "\n"
+	case strings.HasPrefix(command, "new ssl cert "):
+		f.certs[args[3]] = ""
+		return fmt.Sprintf("New empty certificate store '%s'!\n", args[3])
+	case strings.HasPrefix(command, "set ssl cert "):
+		if _, ok := f.certs[args[3]]; !ok || f.failSet {
+			return "unable to load the certificate\n"
+		}
+		f.pending[args[3]] = payload
+		return fmt.Sprintf("Transaction created for certificate %s!\n", args[3])
+	case strings.HasPrefix(command, "commit ssl cert "):
+		f.certs[args[3]] = f.pending[args[3]]
+		delete(f.pending, args[3])
+		return fmt.Sprintf("Committing %s\nSuccess!\n", args[3])
+	case strings.HasPrefix(command, "abort ssl cert "):
+		delete(f.pending, args[3])
+		return "Transaction aborted for certificate!\n"
+	case strings.HasPrefix(command, "del ssl cert "):
+		delete(f.certs, args[3])
+		return fmt.Sprintf("Certificate '%s' deleted!\n", args[3])
+	case strings.HasPrefix(command, "add ssl crt-list "):
+		if f.failAdd {
+			return "'add ssl crt-list' failed\n"
+		}
+		f.crtLists[args[3]] = append(f.crtLists[args[3]], args[4])
+		return "Inserting certificate in crt-list.\nSuccess!\n"
+	default:
+		return "Unknown command.\n"
+	}
+}
+
+func Test_HAProxyRuntimeAPI_UpdateCertificate_existing(t *testing.T) {
+	f := newFakeHAProxy(t, "/certs/example.com.pem")
+	api := NewHAProxyRuntimeAPI("unix:" + f.listener.Addr().String())
+
+	err := api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\n\nKEY\n"), "/certs/")
+	require.NoError(t, err)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	assert.Equal(t, "CERT\nKEY", f.certs["/certs/example.com.pem"])
+	assert.Empty(t, f.crtLists)
+	assert.Equal(t, []string{
+		"show ssl cert",
+		"set ssl cert /certs/example.com.pem",
+		"commit ssl cert /certs/example.com.pem",
+	}, f.commands)
+}
+
+func Test_HAProxyRuntimeAPI_UpdateCertificate_new(t *testing.T) {
+	f := newFakeHAProxy(t, "/certs/example.com.pem")
+	api := NewHAProxyRuntimeAPI(f.listener.Addr().String())
+
+	err := api.UpdateCertificate("/certs/example.org.pem", []byte("CERT\nKEY\n"), "/certs/")
+	require.NoError(t, err)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	assert.Equal(t, "original", f.certs["/certs/example.com.pem"])
+	assert.Equal(t, "CERT\nKEY", f.certs["/certs/example.org.pem"])
+	assert.Equal(t, []string{"/certs/example.org.pem"}, f.crtLists["/certs/"])
+}
+
+func Test_HAProxyRuntimeAPI_UpdateCertificate_failure(t *testing.T) {
+	f := newFakeHAProxy(t, "/certs/example.com.pem")
+	f.mutex.Lock()
+	f.failSet = true
+	f.mutex.Unlock()
+	api := NewHAProxyRuntimeAPI(f.listener.Addr().String())
+
+	err := api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\nKEY\n"), "/certs/")
+	assert.Error(t, err)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	assert.Equal(t, "original", f.certs["/certs/example.com.pem"])
+	assert.Contains(t, f.commands, "abort ssl cert /certs/example.com.pem")
+}
+
+func Test_HAProxyRuntimeAPI_UpdateCertificate_newFailure(t *testing.T) {
+	f := newFakeHAProxy(t)
+	f.mutex.Lock()
+	f.failSet = true
+	f.mutex.Unlock()
+	api := NewHAProxyRuntimeAPI(f.listener.Addr().String())
+
+	assert.Error(t, api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\nKEY\n"), "/certs/"))
+
+	f.mutex.Lock()
+	assert.NotContains(t, f.certs, "/certs/example.com.pem")
+	assert.Contains(t, f.commands, "del ssl cert /certs/example.com.pem")
+	f.failSet = false
+	f.failAdd = true
+	f.mutex.Unlock()
+
+	assert.Error(t, api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\nKEY\n"), "/certs/"))
+
+	f.mutex.Lock()
+	assert.NotContains(t, f.certs, "/certs/example.com.pem")
+	f.failAdd = false
+	f.mutex.Unlock()
+
+	// The next attempt treats the certificate as new again, and adds it to the crt-list
+	require.NoError(t, api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\nKEY\n"), "/certs/"))
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	assert.Equal(t, "CERT\nKEY", f.certs["/certs/example.com.pem"])
+	assert.Equal(t, []string{"/certs/example.com.pem"}, f.crtLists["/certs/"])
+}
+
+func Test_HAProxyRuntimeAPI_UpdateCertificate_unreachable(t *testing.T) {
+	api := NewHAProxyRuntimeAPI(filepath.Join(t.TempDir(), "missing.sock"))
+	assert.Error(t, api.UpdateCertificate("/certs/example.com.pem", []byte("CERT\nKEY\n"), "/certs/"))
+}
+
+func Test_NewHAProxyRuntimeAPI(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		want    string
+	}{
+		{"unix:/var/run/haproxy.sock", "unix", "/var/run/haproxy.sock"},
+		{"/var/run/haproxy.sock", "unix", "/var/run/haproxy.sock"},
+		{"tcp:haproxy:9999", "tcp", "haproxy:9999"},
+		{"haproxy:9999", "tcp", "haproxy:9999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			api := NewHAProxyRuntimeAPI(tt.address)
+			assert.Equal(t, tt.network, api.network)
+			assert.Equal(t, tt.want, api.address)
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+)
+
+// startHTTPServer starts serving metrics and the status API on the given address in the background.
+func startHTTPServer(address string, api *StatusAPI) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	api.register(mux)
+
+	loggers.main.Infof("Listening for HTTP requests on %s", address)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			loggers.main.Errorf("HTTP server failed: %s", err.Error())
+		}
+	}()
+}
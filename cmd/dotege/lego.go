@@ -7,13 +7,18 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/csmith/legotapas"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/http01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/log"
 	"github.com/go-acme/lego/v4/registration"
@@ -47,6 +52,16 @@ type SavedCertificate struct {
 	Certificate       []byte    `json:"certificate"`
 	IssuerCertificate []byte    `json:"issuer"`
 	CSR               []byte    `json:"csr"`
+	// LastUsed is the last time the certificate was known to be needed by a container.
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// CertificateInfo summarises a certificate held by the CertificateManager.
+type CertificateInfo struct {
+	Domains   []string  `json:"domains"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
 }
 
 type CertificateManagerData struct {
@@ -54,23 +69,37 @@ type CertificateManagerData struct {
 	Certs []*SavedCertificate `json:"certs"`
 }
 
+const (
+	AcmeChallengeDns  = "dns"
+	AcmeChallengeHttp = "http"
+)
+
 type CertificateManager struct {
 	logger       *zap.SugaredLogger
 	acmeProvider string
 	keyType      certcrypto.KeyType
 	path         string
 	dnsProvider  string
+	httpAddress  string
 	data         *CertificateManagerData
-	client       *lego.Client
+	clients      map[string]*lego.Client
+
+	// dataMutex guards the certificates in data, which may be read from other goroutines
+	dataMutex sync.Mutex
 }
 
-func NewCertificateManager(logger *zap.SugaredLogger, acmeProvider string, keyType certcrypto.KeyType, dnsProvider string, path string) *CertificateManager {
+// NewCertificateManager creates a new certificate manager. DNS-01 challenges will be solved using the given
+// DNS provider, and HTTP-01 challenges by listening on the given address; either may be empty to disable
+// that type of challenge.
+func NewCertificateManager(logger *zap.SugaredLogger, acmeProvider string, keyType certcrypto.KeyType, dnsProvider string, httpAddress string, path string) *CertificateManager {
 	return &CertificateManager{
 		logger:       logger,
 		acmeProvider: acmeProvider,
 		keyType:      keyType,
 		dnsProvider:  dnsProvider,
+		httpAddress:  httpAddress,
 		path:         path,
+		clients:      make(map[string]*lego.Client),
 	}
 }
 
@@ -84,7 +113,7 @@ func (c *CertificateManager) Init(email string) error {
 		err = c.createUser(email)
 	}
 	if err == nil {
-		err = c.createClient()
+		err = c.createClients()
 	}
 	if err == nil {
 		err = c.register()
@@ -110,6 +139,15 @@ func (c *CertificateManager) load() error {
 		}
 	}
 	c.data = data
+
+	for _, cert := range data.Certs {
+		if cert.LastUsed.IsZero() {
+			// Certificates saved by older versions don't record when they were used, so give them a full grace
+			// period before they're considered unused.
+			cert.LastUsed = time.Now()
+		}
+		updateCertificateMetrics(cert)
+	}
 	return nil
 }
 
@@ -119,7 +157,7 @@ func (c *CertificateManager) save() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(c.path, data, 0600)
+	return writeFileAtomic(c.path, data, 0600, nil)
 }
 
 func (c *CertificateManager) createUser(email string) error {
@@ -145,35 +183,71 @@ func (c *CertificateManager) createUser(email string) error {
 	return nil
 }
 
-func (c *CertificateManager) createClient() error {
-	config := lego.NewConfig(c.data.User)
+// createClients creates a separate ACME client for each type of challenge, as lego doesn't allow us to choose
+// which challenge will be used when multiple providers are configured.
+func (c *CertificateManager) createClients() error {
+	if c.dnsProvider != "" {
+		client, err := c.createClient()
+		if err != nil {
+			return err
+		}
 
-	config.CADirURL = c.acmeProvider
-	config.Certificate.KeyType = c.keyType
+		provider, err := legotapas.CreateProvider(c.dnsProvider)
+		if err != nil {
+			return err
+		}
 
-	client, err := lego.NewClient(config)
-	if err != nil {
-		return err
-	}
+		err = client.Challenge.SetDNS01Provider(provider)
+		if err != nil {
+			return err
+		}
 
-	provider, err := legotapas.CreateProvider(c.dnsProvider)
-	if err != nil {
-		return err
+		c.clients[AcmeChallengeDns] = client
 	}
 
-	err = client.Challenge.SetDNS01Provider(provider)
-	if err != nil {
-		return err
+	if c.httpAddress != "" {
+		client, err := c.createClient()
+		if err != nil {
+			return err
+		}
+
+		host, port, err := net.SplitHostPort(c.httpAddress)
+		if err != nil {
+			return err
+		}
+
+		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer(host, port))
+		if err != nil {
+			return err
+		}
+
+		c.clients[AcmeChallengeHttp] = client
 	}
 
-	c.client = client
+	if len(c.clients) == 0 {
+		return fmt.Errorf("no ACME challenges are configured")
+	}
 	return nil
 }
 
+func (c *CertificateManager) createClient() (*lego.Client, error) {
+	config := lego.NewConfig(c.data.User)
+
+	config.CADirURL = c.acmeProvider
+	config.Certificate.KeyType = c.keyType
+
+	return lego.NewClient(config)
+}
+
 func (c *CertificateManager) register() error {
 	if c.data.User.Registration == nil {
 		c.logger.Infof("Registering new user with ACME provider")
-		reg, err := c.client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		var client *lego.Client
+		for _, client = range c.clients {
+			break
+		}
+
+		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
 		if err != nil {
 			return err
 		}
@@ -183,8 +257,13 @@ func (c *CertificateManager) register() error {
 	return nil
 }
 
-func (c *CertificateManager) GetCertificate(domains []string) (*SavedCertificate, error) {
+// GetCertificate returns a certificate for the given domains, obtaining or renewing it if needed using the
+// given type of challenge. Certificates for wildcard domains are always obtained using DNS-01 challenges.
+func (c *CertificateManager) GetCertificate(domains []string, challenge string) (*SavedCertificate, error) {
+	c.dataMutex.Lock()
 	existing := c.loadCert(domains)
+	c.dataMutex.Unlock()
+
 	if existing != nil {
 		if existing.NotAfter.Before(time.Now().Add(time.Hour * 24 * 31)) {
 			c.logger.Debugf("Found existing certificate for %s, but it expires soon; renewing", domains)
@@ -194,17 +273,141 @@ func (c *CertificateManager) GetCertificate(domains []string) (*SavedCertificate
 		}
 	}
 
+	if challenge == AcmeChallengeHttp && hasWildcard(domains) {
+		c.logger.Debugf("Using DNS challenge for %s as it contains a wildcard", domains)
+		challenge = AcmeChallengeDns
+	}
+
+	client, ok := c.clients[challenge]
+	if !ok {
+		return nil, fmt.Errorf("%s challenges are not configured", challenge)
+	}
+
 	request := certificate.ObtainRequest{
 		Domains: domains,
 		Bundle:  true,
 	}
-	cert, err := c.client.Certificate.Obtain(request)
+	start := time.Now()
+	cert, err := client.Certificate.Obtain(request)
 	if err != nil {
+		metrics.certificateObtains.Inc("result", "failure")
+		metrics.certificateObtainTime.ObserveSince(start, "result", "failure")
 		return nil, err
 	}
+	metrics.certificateObtains.Inc("result", "success")
+	metrics.certificateObtainTime.ObserveSince(start, "result", "success")
+
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
 	return c.saveCert(domains, cert)
 }
 
+// Certificates returns a summary of all certificates currently held, sorted by their first domain.
+func (c *CertificateManager) Certificates() []CertificateInfo {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	res := make([]CertificateInfo, 0, len(c.data.Certs))
+	for _, cert := range c.data.Certs {
+		info := CertificateInfo{
+			Domains:  append([]string(nil), cert.Domains...),
+			NotAfter: cert.NotAfter,
+		}
+		if parsed, err := certcrypto.ParsePEMCertificate(cert.Certificate); err == nil {
+			info.Issuer = parsed.Issuer.String()
+			info.NotBefore = parsed.NotBefore
+		}
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Domains[0] < res[j].Domains[0]
+	})
+	return res
+}
+
+// FindCertificate returns the held certificate whose first domain is the given primary domain, and which covers
+// all the given names. If there are several, the one that expires last is returned. Returns nil if there are none.
+func (c *CertificateManager) FindCertificate(primary string, names []string) *SavedCertificate {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	var res *SavedCertificate
+	for _, cert := range c.data.Certs {
+		if cert.Domains[0] != primary || !coversAll(cert.Domains, names) {
+			continue
+		}
+		if res == nil || cert.NotAfter.After(res.NotAfter) {
+			res = cert
+		}
+	}
+	return res
+}
+
+// coversAll determines whether every one of the names is in the list of domains.
+func coversAll(domains, names []string) bool {
+	for _, name := range names {
+		if !slices.Contains(domains, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkUsed records that the certificates for each of the given sets of domains are still needed.
+func (c *CertificateManager) MarkUsed(domains [][]string) error {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	now := time.Now()
+	for _, d := range domains {
+		if cert := c.loadCert(d); cert != nil {
+			cert.LastUsed = now
+		}
+	}
+	return c.save()
+}
+
+// StaleCertificates splits the held certificates into those that have expired or haven't been used since the given
+// time, and those that are still current.
+func (c *CertificateManager) StaleCertificates(unusedSince time.Time) (stale, current []*SavedCertificate) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	now := time.Now()
+	for _, cert := range c.data.Certs {
+		if cert.NotAfter.Before(now) || cert.LastUsed.Before(unusedSince) {
+			stale = append(stale, cert)
+		} else {
+			current = append(current, cert)
+		}
+	}
+	return
+}
+
+// RemoveCertificates removes the given certificates from the cache.
+func (c *CertificateManager) RemoveCertificates(certs []*SavedCertificate) error {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	var remaining []*SavedCertificate
+	for _, cert := range c.data.Certs {
+		if slices.Contains(certs, cert) {
+			c.logger.Infof("Removing certificate for %s from cache", cert.Domains)
+			metrics.certificateExpiry.Delete("domain", cert.Domains[0])
+		} else {
+			remaining = append(remaining, cert)
+		}
+	}
+	c.data.Certs = remaining
+
+	// Another certificate may have shared the removed one's primary domain.
+	for _, cert := range remaining {
+		updateCertificateMetrics(cert)
+	}
+	return c.save()
+}
+
 func (c *CertificateManager) loadCert(domains []string) *SavedCertificate {
 	for _, cert := range c.data.Certs {
 		if domainsMatch(cert.Domains, domains) {
@@ -214,6 +417,15 @@ func (c *CertificateManager) loadCert(domains []string) *SavedCertificate {
 	return nil
 }
 
+func hasWildcard(domains []string) bool {
+	for _, d := range domains {
+		if strings.HasPrefix(d, "*.") {
+			return true
+		}
+	}
+	return false
+}
+
 func domainsMatch(domains1, domains2 []string) bool {
 	if len(domains1) != len(domains2) {
 		return false
@@ -256,11 +468,18 @@ func (c *CertificateManager) saveCert(domains []string, cert *certificate.Resour
 		CertURL:           cert.CertURL,
 		CSR:               cert.CSR,
 		IssuerCertificate: cert.IssuerCertificate,
+		LastUsed:          time.Now(),
 	}
 	c.data.Certs = append(c.data.Certs, savedCert)
+	updateCertificateMetrics(savedCert)
 	return savedCert, c.save()
 }
 
+// updateCertificateMetrics records the expiry time of the given certificate.
+func updateCertificateMetrics(cert *SavedCertificate) {
+	metrics.certificateExpiry.Set(float64(cert.NotAfter.Unix()), "domain", cert.Domains[0])
+}
+
 func (c *CertificateManager) getExpiry(cert *certificate.Resource) time.Time {
 	pem, err := certcrypto.ParsePEMCertificate(cert.Certificate)
 	if err != nil {
@@ -1,9 +1,33 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func Test_domainsMatch(t *testing.T) {
@@ -42,3 +66,332 @@ func Test_domainsMatch_doesntMutateArgs(t *testing.T) {
 	assert.Equal(t, domains1, []string{"example.com", "b.example.com", "c.example.com"})
 	assert.Equal(t, domains2, []string{"example.com", "c.example.com", "b.example.com"})
 }
+
+// acmeStub is a minimal ACME server, in the style of pebble, that validates HTTP-01 challenges by connecting to
+// the given port on localhost.
+type acmeStub struct {
+	server     *httptest.Server
+	httpPort   string
+	caKey      *ecdsa.PrivateKey
+	caCert     []byte
+	mutex      sync.Mutex
+	thumbprint string
+	orders     []*acmeStubOrder
+}
+
+type acmeStubOrder struct {
+	status      string
+	identifiers []string
+	tokens      []string
+	authzStatus []string
+	certificate []byte
+}
+
+func newAcmeStub(t *testing.T, httpPort string) *acmeStub {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Stub CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	s := &acmeStub{httpPort: httpPort, caKey: caKey, caCert: caCert}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *acmeStub) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+
+	payload, jwk := s.decode(r)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "directory":
+		s.write(w, http.StatusOK, map[string]string{
+			"newNonce":   s.server.URL + "/nonce",
+			"newAccount": s.server.URL + "/account",
+			"newOrder":   s.server.URL + "/new-order",
+			"revokeCert": s.server.URL + "/revoke",
+			"keyChange":  s.server.URL + "/key-change",
+		})
+	case "nonce":
+		w.WriteHeader(http.StatusOK)
+	case "account":
+		s.thumbprint = jwkThumbprint(jwk)
+		w.Header().Set("Location", s.server.URL+"/account/1")
+		s.write(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "new-order":
+		var request struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &request)
+		order := &acmeStubOrder{status: "pending"}
+		for i, identifier := range request.Identifiers {
+			order.identifiers = append(order.identifiers, identifier.Value)
+			order.tokens = append(order.tokens, fmt.Sprintf("token-%d-%d", len(s.orders), i))
+			order.authzStatus = append(order.authzStatus, "pending")
+		}
+		s.orders = append(s.orders, order)
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.server.URL, len(s.orders)-1))
+		s.write(w, http.StatusCreated, s.orderJson(len(s.orders)-1))
+	case "order":
+		s.write(w, http.StatusOK, s.orderJson(atoi(parts[1])))
+	case "authz":
+		s.write(w, http.StatusOK, s.authzJson(atoi(parts[1]), atoi(parts[2])))
+	case "challenge":
+		id, n := atoi(parts[1]), atoi(parts[2])
+		s.validate(id, n)
+		w.Header().Set("Link", fmt.Sprintf("<%s/authz/%d/%d>;rel=\"up\"", s.server.URL, id, n))
+		s.write(w, http.StatusOK, s.authzJson(id, n)["challenges"].([]interface{})[0])
+	case "finalize":
+		id := atoi(parts[1])
+		var request struct{ CSR string }
+		_ = json.Unmarshal(payload, &request)
+		s.issue(id, request.CSR)
+		s.write(w, http.StatusOK, s.orderJson(id))
+	case "certificate":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.orders[atoi(parts[1])].certificate)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// decode extracts the payload and (if present) JWK from a JWS-encoded request. Signatures are not checked.
+func (s *acmeStub) decode(r *http.Request) ([]byte, map[string]string) {
+	var body struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, nil
+	}
+
+	var protected struct {
+		Jwk map[string]string `json:"jwk"`
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(body.Protected)
+	_ = json.Unmarshal(header, &protected)
+
+	payload, _ := base64.RawURLEncoding.DecodeString(body.Payload)
+	return payload, protected.Jwk
+}
+
+func (s *acmeStub) write(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (s *acmeStub) orderJson(id int) map[string]interface{} {
+	order := s.orders[id]
+	var identifiers []map[string]string
+	var authorizations []string
+	for i := range order.identifiers {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": order.identifiers[i]})
+		authorizations = append(authorizations, fmt.Sprintf("%s/authz/%d/%d", s.server.URL, id, i))
+	}
+
+	res := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    identifiers,
+		"authorizations": authorizations,
+		"finalize":       fmt.Sprintf("%s/finalize/%d", s.server.URL, id),
+	}
+	if order.certificate != nil {
+		res["certificate"] = fmt.Sprintf("%s/certificate/%d", s.server.URL, id)
+	}
+	return res
+}
+
+func (s *acmeStub) authzJson(id, n int) map[string]interface{} {
+	order := s.orders[id]
+	return map[string]interface{}{
+		"status":     order.authzStatus[n],
+		"identifier": map[string]string{"type": "dns", "value": order.identifiers[n]},
+		"challenges": []interface{}{
+			map[string]string{
+				"type":   "http-01",
+				"url":    fmt.Sprintf("%s/challenge/%d/%d", s.server.URL, id, n),
+				"token":  order.tokens[n],
+				"status": order.authzStatus[n],
+			},
+		},
+	}
+}
+
+// validate performs an HTTP-01 validation for the given authorization.
+func (s *acmeStub) validate(id, n int) {
+	order := s.orders[id]
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%s/.well-known/acme-challenge/%s", s.httpPort, order.tokens[n]), nil)
+	req.Host = order.identifiers[n]
+
+	order.authzStatus[n] = "invalid"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) == order.tokens[n]+"."+s.thumbprint {
+		order.authzStatus[n] = "valid"
+	}
+
+	order.status = "ready"
+	for i := range order.authzStatus {
+		if order.authzStatus[i] != "valid" {
+			order.status = "pending"
+		}
+	}
+}
+
+// issue signs the given CSR with the stub CA and marks the order as valid.
+func (s *acmeStub) issue(id int, encodedCsr string) {
+	order := s.orders[id]
+	der, _ := base64.RawURLEncoding.DecodeString(encodedCsr)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || order.status != "ready" {
+		order.status = "invalid"
+		return
+	}
+
+	ca, _ := x509.ParseCertificate(s.caCert)
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 2),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 90),
+	}, ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		order.status = "invalid"
+		return
+	}
+
+	order.status = "valid"
+	order.certificate = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert})...,
+	)
+}
+
+// jwkThumbprint calculates the RFC 7638 thumbprint of an EC JWK.
+func jwkThumbprint(jwk map[string]string) string {
+	canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func Test_CertificateManager_httpChallenge(t *testing.T) {
+	port := freePort(t)
+	stub := newAcmeStub(t, port)
+
+	cm := NewCertificateManager(zap.NewNop().Sugar(), stub.server.URL+"/directory", certcrypto.EC256, "", "127.0.0.1:"+port, filepath.Join(t.TempDir(), "certs.json"))
+	require.NoError(t, cm.Init("test@example.com"))
+
+	saved, err := cm.GetCertificate([]string{"example.com", "www.example.com"}, AcmeChallengeHttp)
+	require.NoError(t, err)
+
+	cert, err := certcrypto.ParsePEMCertificate(saved.Certificate)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", cert.Subject.CommonName)
+	assert.ElementsMatch(t, []string{"example.com", "www.example.com"}, cert.DNSNames)
+	assert.Equal(t, cert.NotAfter, saved.NotAfter)
+
+	cached, err := cm.GetCertificate([]string{"www.example.com", "example.com"}, AcmeChallengeHttp)
+	require.NoError(t, err)
+	assert.Same(t, saved, cached)
+}
+
+func Test_CertificateManager_unconfiguredChallenge(t *testing.T) {
+	port := freePort(t)
+	stub := newAcmeStub(t, port)
+
+	cm := NewCertificateManager(zap.NewNop().Sugar(), stub.server.URL+"/directory", certcrypto.EC256, "", "127.0.0.1:"+port, filepath.Join(t.TempDir(), "certs.json"))
+	require.NoError(t, cm.Init("test@example.com"))
+
+	_, err := cm.GetCertificate([]string{"example.com"}, AcmeChallengeDns)
+	assert.Error(t, err)
+
+	_, err = cm.GetCertificate([]string{"*.example.com"}, AcmeChallengeHttp)
+	assert.Error(t, err, "wildcard certificates should require a DNS challenge")
+}
+
+func Test_CertificateManager_FindCertificate(t *testing.T) {
+	expiry := time.Now().Add(time.Hour * 24 * 30)
+	older := &SavedCertificate{Domains: []string{"example.com", "www.example.com"}, NotAfter: expiry}
+	newer := &SavedCertificate{Domains: []string{"example.com", "www.example.com", "api.example.com"}, NotAfter: expiry.Add(time.Hour)}
+	wildcard := &SavedCertificate{Domains: []string{"*.example.org"}, NotAfter: expiry}
+	secondary := &SavedCertificate{Domains: []string{"example.net", "example.com"}, NotAfter: expiry}
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", "")
+	cm.data = &CertificateManagerData{Certs: []*SavedCertificate{older, newer, wildcard, secondary}}
+
+	tests := []struct {
+		name    string
+		primary string
+		names   []string
+		want    *SavedCertificate
+	}{
+		{"prefers later expiry", "example.com", []string{"example.com", "www.example.com"}, newer},
+		{"covers all names", "example.com", []string{"example.com", "api.example.com"}, newer},
+		{"wildcard", "*.example.org", []string{"*.example.org"}, wildcard},
+		{"must be primary domain", "example.com", []string{"example.com", "example.net"}, nil},
+		{"missing name", "example.com", []string{"example.com", "blog.example.com"}, nil},
+		{"unknown domain", "example.io", []string{"example.io"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Same(t, tt.want, cm.FindCertificate(tt.primary, tt.names))
+		})
+	}
+}
+
+func Test_CertificateManager_save(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "certs.json")
+	require.NoError(t, os.WriteFile(path, []byte("previous"), 0644))
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", path)
+	cm.data = &CertificateManagerData{Certs: []*SavedCertificate{{Domains: []string{"example.com"}}}}
+	require.NoError(t, cm.save())
+
+	saved := NewCertificateManager(loggers.main, "", "", "", "", path)
+	require.NoError(t, saved.load())
+	assert.Equal(t, []string{"example.com"}, saved.data.Certs[0].Domains)
+
+	// The file is replaced rather than rewritten, so no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+var metrics = struct {
+	containers                 *Metric
+	proxiedContainers          *Metric
+	hostnames                  *Metric
+	templateRenders            *Metric
+	templateWriteFailures      *Metric
+	templateValidationFailures *Metric
+	templateParseFailures      *Metric
+	templateExecuteFailures    *Metric
+	templateLastRender         *Metric
+	signals                    *Metric
+	signalFailures             *Metric
+	certificateObtains         *Metric
+	certificateObtainTime      *Metric
+	certificateExpiry          *Metric
+}{
+	containers:                 newMetric("dotege_containers", "Number of containers being tracked.", metricGauge),
+	proxiedContainers:          newMetric("dotege_containers_proxied", "Number of containers with a hostname and port.", metricGauge),
+	hostnames:                  newMetric("dotege_hostnames", "Number of primary hostnames.", metricGauge),
+	templateRenders:            newMetric("dotege_template_renders_total", "Number of times each template has been rendered.", metricCounter),
+	templateWriteFailures:      newMetric("dotege_template_write_failures_total", "Number of times writing a template failed.", metricCounter),
+	templateValidationFailures: newMetric("dotege_template_validation_failures_total", "Number of times a generated template failed validation.", metricCounter),
+	templateParseFailures:      newMetric("dotege_template_parse_failures_total", "Number of times a changed template source could not be parsed.", metricCounter),
+	templateExecuteFailures:    newMetric("dotege_template_execute_failures_total", "Number of times executing a template failed.", metricCounter),
+	templateLastRender:         newMetric("dotege_template_last_render_timestamp_seconds", "Time that each template was last rendered.", metricGauge),
+	signals:                    newMetric("dotege_signals_total", "Number of signals sent to containers.", metricCounter),
+	signalFailures:             newMetric("dotege_signal_failures_total", "Number of signals that could not be sent.", metricCounter),
+	certificateObtains:         newMetric("dotege_certificate_obtains_total", "Number of attempts to obtain a certificate using ACME.", metricCounter),
+	certificateObtainTime:      newMetric("dotege_certificate_obtain_duration_seconds", "Time taken to obtain certificates using ACME.", metricSummary),
+	certificateExpiry:          newMetric("dotege_certificate_expiry_timestamp_seconds", "Time at which each certificate expires.", metricGauge),
+}
+
+// Metric is a single named metric, with zero or more values distinguished by their labels.
+type Metric struct {
+	name   string
+	help   string
+	kind   string
+	mutex  sync.Mutex
+	values map[string]float64
+	counts map[string]uint64
+}
+
+func newMetric(name, help, kind string) *Metric {
+	return &Metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		values: make(map[string]float64),
+		counts: make(map[string]uint64),
+	}
+}
+
+// Set sets the value of the metric with the given label key/value pairs.
+func (m *Metric) Set(value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[formatLabels(labels)] = value
+}
+
+// Add increases the value of the metric with the given label key/value pairs.
+func (m *Metric) Add(value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[formatLabels(labels)] += value
+}
+
+// Inc increases the value of the metric with the given label key/value pairs by one.
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Observe records a single observation for a summary metric with the given label key/value pairs.
+func (m *Metric) Observe(value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := formatLabels(labels)
+	m.values[key] += value
+	m.counts[key]++
+}
+
+// ObserveSince records the time elapsed since start for a summary metric.
+func (m *Metric) ObserveSince(start time.Time, labels ...string) {
+	m.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Delete removes the value of the metric with the given label key/value pairs.
+func (m *Metric) Delete(labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := formatLabels(labels)
+	delete(m.values, key)
+	delete(m.counts, key)
+}
+
+// Reset removes all values from the metric.
+func (m *Metric) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values = make(map[string]float64)
+	m.counts = make(map[string]uint64)
+}
+
+// write outputs the metric in the Prometheus text exposition format.
+func (m *Metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if m.kind == metricSummary {
+			_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", m.name, k, formatValue(m.values[k]))
+			_, _ = fmt.Fprintf(w, "%s_count%s %d\n", m.name, k, m.counts[k])
+		} else {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name, k, formatValue(m.values[k]))
+		}
+	}
+}
+
+// formatLabels converts a list of label key/value pairs into the Prometheus label format.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsHandler serves all metrics in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []*Metric{
+		metrics.containers,
+		metrics.proxiedContainers,
+		metrics.hostnames,
+		metrics.templateRenders,
+		metrics.templateWriteFailures,
+		metrics.templateValidationFailures,
+		metrics.templateParseFailures,
+		metrics.templateExecuteFailures,
+		metrics.templateLastRender,
+		metrics.signals,
+		metrics.signalFailures,
+		metrics.certificateObtains,
+		metrics.certificateObtainTime,
+		metrics.certificateExpiry,
+	} {
+		m.write(w)
+	}
+}
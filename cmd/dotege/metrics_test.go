@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metric_write(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   string
+		update func(m *Metric)
+		want   string
+	}{
+		{"empty", metricGauge, func(m *Metric) {}, ""},
+		{"unlabelled gauge", metricGauge, func(m *Metric) { m.Set(3); m.Set(4) }, "test_metric 4\n"},
+		{"labelled counter", metricCounter, func(m *Metric) {
+			m.Inc("name", "b")
+			m.Inc("name", "a")
+			m.Add(2, "name", "b")
+		}, "test_metric{name=\"a\"} 1\ntest_metric{name=\"b\"} 3\n"},
+		{"escaped labels", metricCounter, func(m *Metric) { m.Inc("name", "a\"b\\c\nd") }, "test_metric{name=\"a\\\"b\\\\c\\nd\"} 1\n"},
+		{"multiple labels", metricCounter, func(m *Metric) { m.Inc("a", "1", "b", "2") }, "test_metric{a=\"1\",b=\"2\"} 1\n"},
+		{"deleted", metricGauge, func(m *Metric) {
+			m.Set(1, "name", "a")
+			m.Set(2, "name", "b")
+			m.Delete("name", "a")
+		}, "test_metric{name=\"b\"} 2\n"},
+		{"summary", metricSummary, func(m *Metric) {
+			m.Observe(1.5, "result", "success")
+			m.Observe(2, "result", "success")
+		}, "test_metric_sum{result=\"success\"} 3.5\ntest_metric_count{result=\"success\"} 2\n"},
+		{"reset", metricGauge, func(m *Metric) { m.Set(1, "name", "a"); m.Reset(); m.Set(2, "name", "b") }, "test_metric{name=\"b\"} 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMetric("test_metric", "Test metric.", tt.kind)
+			tt.update(m)
+
+			builder := &strings.Builder{}
+			m.write(builder)
+			assert.Equal(t, "# HELP test_metric Test metric.\n# TYPE test_metric "+tt.kind+"\n"+tt.want, builder.String())
+		})
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	metrics.hostnames.Set(12)
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "# TYPE dotege_hostnames gauge\ndotege_hostnames 12\n")
+	assert.Contains(t, recorder.Body.String(), "# TYPE dotege_certificate_obtain_duration_seconds summary\n")
+}
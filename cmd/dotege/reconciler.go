@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// reconcilerJitter is how long to wait after a change before regenerating templates, so that bursts of
+	// changes are dealt with together.
+	reconcilerJitter = 100 * time.Millisecond
+	// reconcilerStartupDelay is how long to wait for the initial set of containers to be found before the first
+	// update.
+	reconcilerStartupDelay = time.Minute
+	// reconcilerRedeployInterval is how often certificates for all containers are checked for renewal.
+	reconcilerRedeployInterval = time.Hour * 24
+)
+
+// TemplateData is the data passed to templates when they are generated.
+type TemplateData struct {
+	Containers      map[string]*Container
+	Hostnames       map[string]*Hostname
+	Groups          []string
+	Users           []User
+	AcmeHttpBackend string
+	Certificates    []*Certificate
+}
+
+// Reconciler keeps track of containers, and regenerates templates, deploys certificates and signals containers
+// in response to changes. Its state is only ever accessed from the goroutine executing Run; other goroutines
+// are given immutable snapshots.
+type Reconciler struct {
+	config       *Config
+	client       DockerClient
+	templates    Templates
+	certificates *CertificateManager
+	haproxy      *HAProxyRuntimeAPI
+	status       *StatusAPI
+
+	jitter       time.Duration
+	startupDelay time.Duration
+
+	containers Containers
+	updated    Containers
+	ignored    Containers
+	users      []User
+}
+
+// NewReconciler creates a new reconciler. The certificate manager and haproxy runtime API may be nil if they are
+// not in use.
+func NewReconciler(config *Config, client DockerClient, templates Templates, certificates *CertificateManager, haproxy *HAProxyRuntimeAPI, status *StatusAPI) *Reconciler {
+	return &Reconciler{
+		config:       config,
+		client:       client,
+		templates:    templates,
+		certificates: certificates,
+		haproxy:      haproxy,
+		status:       status,
+		jitter:       reconcilerJitter,
+		startupDelay: reconcilerStartupDelay,
+		containers:   make(Containers),
+		updated:      make(Containers),
+		ignored:      make(Containers),
+		users:        config.Users,
+	}
+}
+
+// Run processes container events, user changes and template changes until the context is cancelled.
+func (r *Reconciler) Run(ctx context.Context, events <-chan ContainerEvent, users <-chan []User, templates <-chan *Template) {
+	updateTimer := time.NewTimer(r.startupDelay)
+	defer updateTimer.Stop()
+
+	redeployTicker := time.NewTicker(reconcilerRedeployInterval)
+	defer redeployTicker.Stop()
+
+	collected := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			r.handleEvent(event)
+			resetTimer(updateTimer, r.jitter)
+		case u := <-users:
+			r.users = u
+			resetTimer(updateTimer, r.jitter)
+		case t := <-templates:
+			if err := t.Reload(); err != nil {
+				loggers.main.Errorf("Unable to parse template %s, keeping previous version: %v", t.source, err)
+			} else {
+				resetTimer(updateTimer, r.jitter)
+			}
+		case <-updateTimer.C:
+			r.update()
+			if !collected {
+				// Clean up once the initial containers are known, rather than waiting for the first redeploy.
+				collected = true
+				if r.collectGarbage() {
+					r.certificatesChanged()
+				}
+			}
+		case <-redeployTicker.C:
+			r.redeploy()
+		}
+	}
+}
+
+// handleEvent updates the known containers in response to the given event.
+func (r *Reconciler) handleEvent(event ContainerEvent) {
+	container := event.Container
+	switch event.Operation {
+	case Added, Changed:
+		if container.Labels[labelProxyTag] == r.config.ProxyTag {
+			if event.Operation == Added {
+				loggers.main.Debugf("Container added: %s", container.Name)
+				loggers.containers.Debugf("New container with name %s has id: %s", container.Name, container.Id)
+			} else {
+				loggers.main.Debugf("Container changed: %s", container.Name)
+			}
+			r.containers[container.Id] = &container
+			r.updated[container.Id] = &container
+			delete(r.ignored, container.Id)
+		} else {
+			loggers.main.Debugf("Container ignored due to proxy tag: %s (wanted: '%s', got: '%s')", container.Name, r.config.ProxyTag, container.Labels[labelProxyTag])
+			r.ignored[container.Id] = &container
+			delete(r.containers, container.Id)
+			delete(r.updated, container.Id)
+		}
+	case Removed:
+		loggers.main.Debugf("Container removed: %s", container.Id)
+
+		_, inUpdated := r.updated[container.Id]
+		_, inExisting := r.containers[container.Id]
+		loggers.containers.Debugf(
+			"Removed container with ID %s, was in updated containers: %t, main containers: %t",
+			container.Id,
+			inUpdated,
+			inExisting,
+		)
+
+		delete(r.updated, container.Id)
+		delete(r.containers, container.Id)
+		delete(r.ignored, container.Id)
+	}
+}
+
+// update regenerates templates and deploys certificates for any containers that have changed, and then signals
+// any containers that need to pick up the changes.
+func (r *Reconciler) update() {
+	loggers.containers.Debugf("Processing updated containers: %v", r.updated)
+	hostnames := r.containers.Hostnames(r.config.RequireHealthy)
+	updateContainerMetrics(r.containers, hostnames)
+	r.status.Update(r.containers, r.ignored, hostnames)
+
+	signals := r.regenerate(hostnames)
+
+	certsUpdated := false
+	for id, container := range r.updated {
+		certDeployed := r.deployCertForContainer(container)
+		certsUpdated = certsUpdated || certDeployed
+		delete(r.updated, id)
+	}
+
+	if certsUpdated {
+		// Templates are only given the paths of certificates that have been deployed, so may need updating.
+		signals = append(signals, r.regenerate(hostnames)...)
+		signals = append(signals, r.config.Signals...)
+	}
+
+	r.signalContainers(signals)
+}
+
+// regenerate records the certificates deployed for the given hostnames and generates all templates, returning
+// the signals needed for any that changed to be picked up.
+func (r *Reconciler) regenerate(hostnames map[string]*Hostname) []ContainerSignal {
+	data := TemplateData{
+		Containers:      r.containers,
+		Hostnames:       hostnames,
+		Groups:          groups(r.users),
+		Users:           r.users,
+		AcmeHttpBackend: r.config.Acme.HttpBackend,
+		Certificates:    r.setCertificates(hostnames),
+	}
+	return r.templates.Generate(data).Signals(r.config.Signals)
+}
+
+// setCertificates records the certificate covering each hostname, and where it has been deployed to. Returns all
+// the certificates that cover at least one hostname, sorted by their primary domain.
+func (r *Reconciler) setCertificates(hostnames map[string]*Hostname) []*Certificate {
+	r.setCertificatePaths(hostnames)
+	for _, h := range hostnames {
+		h.Certificate = nil
+	}
+
+	if r.config.CertificateDeployment == CertificateDeploymentDisabled || r.certificates == nil {
+		return nil
+	}
+
+	now := time.Now()
+	found := make(map[*SavedCertificate]*Certificate)
+	var res []*Certificate
+	for _, h := range hostnames {
+		saved := r.findCertificate(h)
+		if saved == nil {
+			continue
+		}
+
+		certificate, ok := found[saved]
+		if !ok {
+			certificate = newCertificate(saved, now)
+			found[saved] = certificate
+			res = append(res, certificate)
+		}
+		certificate.CertificateFile, certificate.KeyFile = h.CertificateFile, h.KeyFile
+		h.Certificate = certificate
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Domains[0] < res[j].Domains[0]
+	})
+	return res
+}
+
+// findCertificate returns the saved certificate for the hostname, or nil if there isn't one. Certificates are
+// obtained for each container, so if no certificate covers all the hostname's alternatives (because they're spread
+// across several containers) then the one expiring last out of those obtained for its containers is used.
+func (r *Reconciler) findCertificate(h *Hostname) *SavedCertificate {
+	names := applyWildcards(append([]string{h.Name}, maps.Keys(h.Alternatives)...), r.config.WildCardDomains)
+	if saved := r.certificates.FindCertificate(names[0], names); saved != nil {
+		return saved
+	}
+
+	var res *SavedCertificate
+	for _, container := range h.Containers {
+		containerNames := container.CertNames(r.config.WildCardDomains)
+		if len(containerNames) == 0 {
+			continue
+		}
+
+		saved := r.certificates.FindCertificate(names[0], containerNames)
+		if saved != nil && (res == nil || saved.NotAfter.After(res.NotAfter)) {
+			res = saved
+		}
+	}
+	return res
+}
+
+// newCertificate describes the saved certificate for use in templates, checking its validity at the given time.
+func newCertificate(saved *SavedCertificate, now time.Time) *Certificate {
+	certificate := &Certificate{
+		Domains:  append([]string(nil), saved.Domains...),
+		NotAfter: saved.NotAfter,
+	}
+	for _, domain := range saved.Domains {
+		if strings.HasPrefix(domain, "*.") {
+			certificate.Wildcard = domain
+			break
+		}
+	}
+	if parsed, err := certcrypto.ParsePEMCertificate(saved.Certificate); err == nil {
+		certificate.NotBefore = parsed.NotBefore
+	}
+	certificate.Valid = !now.Before(certificate.NotBefore) && now.Before(certificate.NotAfter)
+	return certificate
+}
+
+// setCertificatePaths records where each hostname's certificate and private key have been deployed to, if they
+// exist.
+func (r *Reconciler) setCertificatePaths(hostnames map[string]*Hostname) {
+	if r.config.CertificateDeployment == CertificateDeploymentDisabled {
+		return
+	}
+
+	for _, h := range hostnames {
+		domain := applyWildcards([]string{h.Name}, r.config.WildCardDomains)[0]
+		certFile := path.Join(r.config.DefaultCertDestination, certificateFileName(domain, "pem"))
+		keyFile := certFile
+		if r.config.CertificateDeployment == CertificateDeploymentSplit {
+			keyFile = path.Join(r.config.DefaultCertDestination, certificateFileName(domain, "key"))
+		}
+
+		if fileExists(certFile) && fileExists(keyFile) {
+			h.CertificateFile, h.KeyFile = certFile, keyFile
+		} else {
+			h.CertificateFile, h.KeyFile = "", ""
+		}
+	}
+}
+
+// redeploy checks the certificates for all known containers, renewing them if required, and then removes any
+// certificates that are no longer needed. Templates are regenerated if any certificates changed.
+func (r *Reconciler) redeploy() {
+	loggers.main.Info("Performing periodic certificate refresh")
+	updated := false
+
+	for _, container := range r.containers {
+		if r.deployCertForContainer(container) {
+			updated = true
+		}
+	}
+
+	if r.collectGarbage() {
+		updated = true
+	}
+
+	if updated {
+		r.certificatesChanged()
+	}
+}
+
+// certificatesChanged regenerates templates that may refer to certificates that have been deployed or removed,
+// and signals containers to pick up the changes.
+func (r *Reconciler) certificatesChanged() {
+	signals := r.regenerate(r.containers.Hostnames(r.config.RequireHealthy))
+	r.signalContainers(append(signals, r.config.Signals...))
+}
+
+// signalContainers sends each of the given signals to the corresponding container. Duplicate signals are only
+// sent once.
+func (r *Reconciler) signalContainers(signals []ContainerSignal) {
+	sent := make(map[ContainerSignal]bool)
+	for _, s := range signals {
+		if sent[s] {
+			continue
+		}
+		sent[s] = true
+
+		var container *Container
+		for _, c := range r.containers {
+			if c.Name == s.Name && c.Running() {
+				container = c
+			}
+		}
+
+		if container != nil {
+			loggers.main.Debugf("Killing container %s (%s) with signal %s", container.Name, container.Id, s.Signal)
+			metrics.signals.Inc("container", s.Name, "signal", s.Signal)
+			err := r.client.ContainerKill(context.Background(), container.Id, s.Signal)
+			if err != nil {
+				loggers.main.Errorf("Unable to send signal %s to container %s: %s", s.Signal, s.Name, err.Error())
+				metrics.signalFailures.Inc("container", s.Name, "signal", s.Signal)
+			}
+		} else {
+			loggers.main.Warnf("Couldn't signal container %s as it is not running", s.Name)
+			metrics.signalFailures.Inc("container", s.Name, "signal", s.Signal)
+		}
+	}
+}
+
+// deployCertForContainer obtains and deploys the certificate for the given container, returning true if the
+// proxy needs to be signalled to pick up the change.
+func (r *Reconciler) deployCertForContainer(container *Container) bool {
+	if r.config.CertificateDeployment == CertificateDeploymentDisabled {
+		return false
+	}
+
+	if !container.Running() {
+		loggers.main.Debugf("Not deploying certificate for container %s as it is not running", container.Name)
+		return false
+	}
+
+	hostnames := container.CertNames(r.config.WildCardDomains)
+	if len(hostnames) == 0 {
+		loggers.main.Debugf("No labels found for container %s", container.Name)
+		return false
+	}
+
+	cert, err := r.certificates.GetCertificate(hostnames, container.AcmeChallenge(r.config.Acme.Challenge))
+	if err != nil {
+		loggers.main.Warnf("Unable to generate certificate for %s: %s", container.Name, err.Error())
+		return false
+	}
+
+	var updated bool
+	if r.config.CertificateDeployment == CertificateDeploymentSplit {
+		updated = r.deploySplitCert(cert)
+	} else {
+		updated = r.deployCombinedCert(cert)
+	}
+
+	if updated && r.haproxy != nil {
+		return !r.updateHAProxyCertificate(cert)
+	}
+	return updated
+}
+
+// updateHAProxyCertificate sends the certificate to haproxy using its runtime API, returning true if successful.
+func (r *Reconciler) updateHAProxyCertificate(certificate *SavedCertificate) bool {
+	name := path.Join(r.config.HAProxy.CertPath, certificateFileName(certificate.Domains[0], "pem"))
+	content := append(append([]byte{}, certificate.Certificate...), certificate.PrivateKey...)
+	if err := r.haproxy.UpdateCertificate(name, content, r.config.HAProxy.CrtList); err != nil {
+		loggers.main.Warnf("Unable to update certificate %s using haproxy runtime API, falling back to signal: %s", name, err.Error())
+		return false
+	}
+
+	loggers.main.Infof("Updated certificate %s using haproxy runtime API", name)
+	return true
+}
+
+// deploySplitCert writes the certificate and private key to separate files. Both files are switched to the new
+// version at once, so consumers never see a certificate paired with the wrong key.
+func (r *Reconciler) deploySplitCert(certificate *SavedCertificate) bool {
+	certName := certificateFileName(certificate.Domains[0], "pem")
+	keyName := certificateFileName(certificate.Domains[0], "key")
+	certTarget := path.Join(r.config.DefaultCertDestination, certName)
+	keyTarget := path.Join(r.config.DefaultCertDestination, keyName)
+
+	certBuf, _ := ioutil.ReadFile(certTarget)
+	keyBuf, _ := ioutil.ReadFile(keyTarget)
+	if bytes.Equal(certBuf, certificate.Certificate) && bytes.Equal(keyBuf, certificate.PrivateKey) {
+		loggers.main.Debugf("Certificate and key were up to date: %s", certTarget)
+		return false
+	}
+
+	err := writeFilesAtomic(
+		r.config.DefaultCertDestination,
+		certificateBaseName(certificate.Domains[0]),
+		map[string][]byte{certName: certificate.Certificate, keyName: certificate.PrivateKey},
+		r.config.CertMode,
+		r.config.CertUid,
+		r.config.CertGid,
+	)
+	if err != nil {
+		loggers.main.Warnf("Unable to write certificate %s - %s", certTarget, err.Error())
+		return false
+	}
+
+	loggers.main.Infof("Updated certificate files %s and %s", certTarget, keyTarget)
+	return true
+}
+
+// deployCombinedCert writes the certificate and private key to a single file.
+func (r *Reconciler) deployCombinedCert(certificate *SavedCertificate) bool {
+	name := certificateFileName(certificate.Domains[0], "pem")
+	target := path.Join(r.config.DefaultCertDestination, name)
+	content := append(append([]byte{}, certificate.Certificate...), certificate.PrivateKey...)
+
+	buf, _ := ioutil.ReadFile(target)
+	if bytes.Equal(buf, content) {
+		loggers.main.Debugf("Certificate was up to date: %s", target)
+		return false
+	}
+
+	err := writeFileAtomic(target, content, r.config.CertMode, func(temp string) error {
+		return os.Chown(temp, r.config.CertUid, r.config.CertGid)
+	})
+	if err != nil {
+		loggers.main.Warnf("Unable to write certificate %s - %s", target, err.Error())
+		return false
+	}
+
+	loggers.main.Infof("Updated certificate file %s", target)
+	return true
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReconciler(t *testing.T, client *fakeDockerClient) (*Reconciler, string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hosts.tpl"), []byte("{{ range .Hostnames }}{{ .Name }}\n{{ end }}"), 0600))
+
+	templates := Templates{CreateTemplate(filepath.Join(dir, "hosts.tpl"), filepath.Join(dir, "hosts"), nil, nil, nil)}
+	cfg := &Config{
+		CertificateDeployment: CertificateDeploymentDisabled,
+		Signals:               []ContainerSignal{{Name: "proxy", Signal: "HUP"}},
+	}
+
+	reconciler := NewReconciler(cfg, client, templates, nil, nil, NewStatusAPI(templates, nil, "", false))
+	reconciler.jitter = time.Millisecond
+	reconciler.startupDelay = time.Millisecond
+	return reconciler, filepath.Join(dir, "hosts")
+}
+
+func Test_Reconciler_updatesTemplatesAndSignals(t *testing.T) {
+	client := newFakeDockerClient()
+	client.containers = []types.Container{
+		{ID: "proxy", Names: []string{"/proxy"}, State: StateRunning},
+		{ID: "web", Names: []string{"/web"}, State: StateRunning, Labels: map[string]string{labelVhost: "example.com"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reconciler, output := newTestReconciler(t, client)
+	containerEvents := make(chan ContainerEvent)
+	go ContainerMonitor{client: client}.monitor(ctx, containerEvents)
+	go reconciler.Run(ctx, containerEvents, make(chan []User), make(chan *Template))
+
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "example.com\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"proxy:HUP"}, client.signalsSent())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client.setInspect("api", "api", StateRunning, "", map[string]string{labelVhost: "api.example.com"})
+	client.events <- events.Message{Action: "start", Actor: events.Actor{ID: "api"}}
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "api.example.com\nexample.com\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client.events <- events.Message{Action: "destroy", Actor: events.Actor{ID: "web"}}
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "api.example.com\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(client.signalsSent()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_Reconciler_usersUpdate(t *testing.T) {
+	client := newFakeDockerClient()
+	reconciler, output := newTestReconciler(t, client)
+	require.NoError(t, os.WriteFile(reconciler.templates[0].source, []byte("{{ range .Users }}{{ .Name }}\n{{ end }}"), 0600))
+	reconciler.templates[0] = CreateTemplate(reconciler.templates[0].source, output, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	users := make(chan []User)
+	go reconciler.Run(ctx, make(chan ContainerEvent), users, make(chan *Template))
+	users <- []User{{Name: "alice"}}
+
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "alice\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_Reconciler_templateChanges(t *testing.T) {
+	client := newFakeDockerClient()
+	client.containers = []types.Container{
+		{ID: "web", Names: []string{"/web"}, State: StateRunning, Labels: map[string]string{labelVhost: "example.com"}},
+	}
+	reconciler, output := newTestReconciler(t, client)
+	source := reconciler.templates[0].source
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	containerEvents := make(chan ContainerEvent)
+	templateChanges := make(chan *Template)
+	require.NoError(t, reconciler.templates.Watch(ctx, templateChanges))
+	go ContainerMonitor{client: client}.monitor(ctx, containerEvents)
+	go reconciler.Run(ctx, containerEvents, make(chan []User), templateChanges)
+
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "example.com\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(source, []byte("{{ range .Hostnames }}server {{ .Name }}\n{{ end }}"), 0600))
+	assert.Eventually(t, func() bool {
+		buf, _ := os.ReadFile(output)
+		return string(buf) == "server example.com\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(source, []byte("{{ range .Hostnames }"), 0600))
+	assert.Eventually(t, func() bool {
+		return reconciler.templates[0].Status().ParseError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	buf, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "server example.com\n", string(buf))
+}
+
+func Test_Reconciler_setCertificatePaths(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.pem"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.key"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "_.example.org.pem"), nil, 0600))
+
+	tests := []struct {
+		name       string
+		deployment string
+		hostname   string
+		wantCert   string
+		wantKey    string
+	}{
+		{"combined", CertificateDeploymentCombined, "example.com", filepath.Join(dir, "example.com.pem"), filepath.Join(dir, "example.com.pem")},
+		{"split", CertificateDeploymentSplit, "example.com", filepath.Join(dir, "example.com.pem"), filepath.Join(dir, "example.com.key")},
+		{"disabled", CertificateDeploymentDisabled, "example.com", "", ""},
+		{"wildcard", CertificateDeploymentCombined, "www.example.org", filepath.Join(dir, "_.example.org.pem"), filepath.Join(dir, "_.example.org.pem")},
+		{"missing key", CertificateDeploymentSplit, "www.example.org", "", ""},
+		{"not deployed", CertificateDeploymentCombined, "example.net", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reconciler := NewReconciler(&Config{
+				CertificateDeployment:  tt.deployment,
+				DefaultCertDestination: dir,
+				WildCardDomains:        []string{"example.org"},
+			}, nil, nil, nil, nil, nil)
+
+			hostname := NewHostname(tt.hostname)
+			reconciler.setCertificatePaths(map[string]*Hostname{tt.hostname: hostname})
+			assert.Equal(t, tt.wantCert, hostname.CertificateFile)
+			assert.Equal(t, tt.wantKey, hostname.KeyFile)
+		})
+	}
+}
+
+func Test_Reconciler_setCertificates(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.pem"), nil, 0600))
+
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	notAfter := time.Now().Add(time.Hour * 24 * 60).Truncate(time.Second).UTC()
+	expired := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", "")
+	cm.data = &CertificateManagerData{Certs: []*SavedCertificate{
+		{Domains: []string{"example.com", "www.example.com"}, NotAfter: notAfter, Certificate: selfSignedCertificate(t, "Test CA", []string{"example.com"}, notBefore, notAfter)},
+		{Domains: []string{"*.example.org"}, NotAfter: expired, Certificate: selfSignedCertificate(t, "Test CA", []string{"*.example.org"}, notBefore, expired)},
+	}}
+
+	reconciler := NewReconciler(&Config{
+		CertificateDeployment:  CertificateDeploymentCombined,
+		DefaultCertDestination: dir,
+		WildCardDomains:        []string{"example.org"},
+	}, nil, nil, cm, nil, nil)
+
+	containers := Containers{
+		"a": {Id: "a", Name: "a", State: StateRunning, Labels: map[string]string{labelVhost: "example.com, www.example.com"}},
+		"b": {Id: "b", Name: "b", State: StateRunning, Labels: map[string]string{labelVhost: "a.example.org"}},
+		"c": {Id: "c", Name: "c", State: StateRunning, Labels: map[string]string{labelVhost: "b.example.org"}},
+		"d": {Id: "d", Name: "d", State: StateRunning, Labels: map[string]string{labelVhost: "example.net"}},
+	}
+	hostnames := containers.Hostnames(false)
+
+	certificates := reconciler.setCertificates(hostnames)
+	require.Len(t, certificates, 2)
+
+	// The wildcard certificate hasn't been deployed, so has no paths
+	assert.Equal(t, &Certificate{
+		Domains:   []string{"*.example.org"},
+		Wildcard:  "*.example.org",
+		NotBefore: notBefore,
+		NotAfter:  expired,
+		Valid:     false,
+	}, certificates[0])
+	assert.Equal(t, &Certificate{
+		Domains:         []string{"example.com", "www.example.com"},
+		CertificateFile: filepath.Join(dir, "example.com.pem"),
+		KeyFile:         filepath.Join(dir, "example.com.pem"),
+		NotBefore:       notBefore,
+		NotAfter:        notAfter,
+		Valid:           true,
+	}, certificates[1])
+
+	assert.Same(t, certificates[1], hostnames["example.com"].Certificate)
+	assert.Same(t, certificates[0], hostnames["a.example.org"].Certificate)
+	assert.Same(t, certificates[0], hostnames["b.example.org"].Certificate)
+	assert.Nil(t, hostnames["example.net"].Certificate)
+}
+
+func Test_Reconciler_setCertificates_sharedHostname(t *testing.T) {
+	expiry := time.Now().Add(time.Hour * 24 * 60).Truncate(time.Second).UTC()
+	web := &SavedCertificate{Domains: []string{"example.com", "www.example.com"}, NotAfter: expiry}
+	api := &SavedCertificate{Domains: []string{"example.com", "api.example.com"}, NotAfter: expiry.Add(time.Hour)}
+	wildcard := &SavedCertificate{Domains: []string{"example.org", "*.example.org"}, NotAfter: expiry}
+
+	cm := NewCertificateManager(loggers.main, "", "", "", "", "")
+	cm.data = &CertificateManagerData{Certs: []*SavedCertificate{web, api, wildcard}}
+
+	reconciler := NewReconciler(&Config{
+		CertificateDeployment:  CertificateDeploymentSplit,
+		DefaultCertDestination: t.TempDir(),
+		WildCardDomains:        []string{"example.org"},
+	}, nil, nil, cm, nil, nil)
+
+	containers := Containers{
+		"web":  {Id: "web", Name: "web", State: StateRunning, Labels: map[string]string{labelVhost: "example.com www.example.com"}},
+		"api":  {Id: "api", Name: "api", State: StateRunning, Labels: map[string]string{labelVhost: "example.com/api api.example.com"}},
+		"blog": {Id: "blog", Name: "blog", State: StateRunning, Labels: map[string]string{labelVhost: "example.org www.example.org"}},
+	}
+	hostnames := containers.Hostnames(false)
+
+	certificates := reconciler.setCertificates(hostnames)
+	require.Len(t, certificates, 2)
+
+	// No certificate covers both containers' alternatives, so the one obtained for either container is used
+	require.NotNil(t, hostnames["example.com"].Certificate)
+	assert.Equal(t, []string{"example.com", "api.example.com"}, hostnames["example.com"].Certificate.Domains)
+
+	// The wildcard isn't the certificate's primary domain
+	require.NotNil(t, hostnames["example.org"].Certificate)
+	assert.Equal(t, "*.example.org", hostnames["example.org"].Certificate.Wildcard)
+}
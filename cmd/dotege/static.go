@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StaticRoute describes a backend that isn't a docker container, such as a service running on the host.
+type StaticRoute struct {
+	// Hostname (or comma- or space-delimited hostnames) that the route handles requests for.
+	Hostname string `yaml:"hostname"`
+	// Target is the host and port to send requests to, e.g. "192.168.1.10:5000".
+	Target string `yaml:"target"`
+	// Auth is the name of a group that users must be in to access the route. Optional.
+	Auth string `yaml:"auth"`
+	// Headers are sent to the client in all responses from the route. Optional.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Container describes the route as a container, so it can be proxied exactly like labelled containers.
+func (r StaticRoute) Container(proxyTag string) (Container, error) {
+	if r.Hostname == "" {
+		return Container{}, fmt.Errorf("no hostname specified")
+	}
+
+	host, port, err := net.SplitHostPort(r.Target)
+	if err != nil {
+		return Container{}, fmt.Errorf("invalid target for %s: %w", r.Hostname, err)
+	}
+	if _, err := strconv.Atoi(port); err != nil || host == "" {
+		return Container{}, fmt.Errorf("invalid target for %s: %s", r.Hostname, r.Target)
+	}
+
+	labels := map[string]string{
+		labelVhost: r.Hostname,
+		labelProxy: port,
+	}
+	if proxyTag != "" {
+		labels[labelProxyTag] = proxyTag
+	}
+	if r.Auth != "" {
+		labels[labelAuth] = r.Auth
+	}
+	for name, value := range r.Headers {
+		labels[fmt.Sprintf("%s.%s", labelHeaders, name)] = fmt.Sprintf("%s: %s", name, value)
+	}
+
+	return Container{
+		Id:     fmt.Sprintf("static:%s@%s", r.Hostname, r.Target),
+		Name:   host,
+		Labels: labels,
+		State:  StateRunning,
+	}, nil
+}
+
+// readStaticRoutes reads a YAML list of static routes from the given file, and describes each of them as a
+// container.
+func readStaticRoutes(path, proxyTag string) ([]Container, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []StaticRoute
+	if err := yaml.UnmarshalStrict(buf, &routes); err != nil {
+		return nil, err
+	}
+
+	var containers []Container
+	seen := make(map[string]bool)
+	for i := range routes {
+		container, err := routes[i].Container(proxyTag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %d: %w", i+1, err)
+		}
+
+		if seen[container.Id] {
+			return nil, fmt.Errorf("invalid route %d: duplicate route for %s to %s", i+1, routes[i].Hostname, routes[i].Target)
+		}
+		seen[container.Id] = true
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// watchStaticRoutes publishes events for the static routes defined in the given file, re-reading it whenever it
+// changes. If the file can't be read when it changes, the existing routes are kept.
+func watchStaticRoutes(ctx context.Context, path, proxyTag string, output chan<- ContainerEvent) error {
+	routes, err := readStaticRoutes(path, proxyTag)
+	if err != nil {
+		return err
+	}
+
+	changes := make(chan []Container)
+	err = watchFile(ctx, path, func() {
+		routes, err := readStaticRoutes(path, proxyTag)
+		if err != nil {
+			loggers.main.Errorf("Unable to reload static routes file %s, keeping existing routes: %v", path, err)
+			return
+		}
+
+		loggers.main.Infof("Static routes file %s changed, loaded %d routes", path, len(routes))
+		select {
+		case changes <- routes:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		known := make(map[string]Container)
+		publishAll(ctx, output, known, routes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case routes := <-changes:
+				publishAll(ctx, output, known, routes)
+			}
+		}
+	}()
+	return nil
+}
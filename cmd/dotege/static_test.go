@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readStaticRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Container
+		wantErr bool
+	}{
+		{
+			name: "full route",
+			content: `
+- hostname: nas.example.com
+  target: 192.168.1.10:5000
+  auth: admins
+  headers:
+    X-Frame-Options: DENY
+`,
+			want: []Container{{
+				Id:   "static:nas.example.com@192.168.1.10:5000",
+				Name: "192.168.1.10",
+				Labels: map[string]string{
+					labelVhost:                        "nas.example.com",
+					labelProxy:                        "5000",
+					labelProxyTag:                     "public",
+					labelAuth:                         "admins",
+					labelHeaders + ".X-Frame-Options": "X-Frame-Options: DENY",
+				},
+				State: StateRunning,
+			}},
+		},
+		{
+			name:    "multiple routes",
+			content: "- {hostname: a.example.com, target: 'host:80'}\n- {hostname: b.example.com, target: 'host:81'}\n",
+			want: []Container{
+				{Id: "static:a.example.com@host:80", Name: "host", Labels: map[string]string{labelVhost: "a.example.com", labelProxy: "80", labelProxyTag: "public"}, State: StateRunning},
+				{Id: "static:b.example.com@host:81", Name: "host", Labels: map[string]string{labelVhost: "b.example.com", labelProxy: "81", labelProxyTag: "public"}, State: StateRunning},
+			},
+		},
+		{name: "empty file", content: ""},
+		{name: "missing hostname", content: "- target: host:80\n", wantErr: true},
+		{name: "missing port", content: "- {hostname: example.com, target: host}\n", wantErr: true},
+		{name: "invalid port", content: "- {hostname: example.com, target: 'host:http'}\n", wantErr: true},
+		{name: "missing host", content: "- {hostname: example.com, target: ':80'}\n", wantErr: true},
+		{name: "unknown key", content: "- {hostname: example.com, target: 'host:80', port: 80}\n", wantErr: true},
+		{name: "duplicate", content: "- {hostname: example.com, target: 'host:80'}\n- {hostname: example.com, target: 'host:80'}\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			got, err := readStaticRoutes(path, "public")
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_watchStaticRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("- {hostname: nas.example.com, target: 'nas:5000'}\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	require.NoError(t, watchStaticRoutes(ctx, path, "", output))
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "nas", event.Container.Name)
+	assert.Contains(t, Containers{event.Container.Id: &event.Container}.Hostnames(false), "nas.example.com")
+
+	require.NoError(t, os.WriteFile(path, []byte("- {hostname: vm.example.com, target: 'vm:80'}\n"), 0600))
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "vm", event.Container.Name)
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Removed), event.Operation)
+	assert.Equal(t, "static:nas.example.com@nas:5000", event.Container.Id)
+}
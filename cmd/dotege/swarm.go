@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+const (
+	// serviceStateNoTasks is the state given to services that don't have any running tasks.
+	serviceStateNoTasks = "no running tasks"
+
+	// labelSwarmServiceId is added by Docker to each container that's running as a task of a swarm service.
+	labelSwarmServiceId = "com.docker.swarm.service.id"
+)
+
+// ServiceMonitor publishes events about Docker Swarm services, treating each service as a single container that
+// can be reached using the service's virtual IP, or using DNS round-robin if the service is configured to use it.
+type ServiceMonitor struct {
+	client DockerClient
+
+	// minBackoff and maxBackoff control how long to wait between attempts to reconnect. If zero, the defaults are
+	// used.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// resyncInterval is how often to check the list of services for any changes we missed. As the number of running
+	// tasks doesn't generate service events, this also controls how quickly services that start or stop all of their
+	// tasks are noticed. If zero, the default is used.
+	resyncInterval time.Duration
+}
+
+// monitor publishes events about services until the context is cancelled. If the connection to the Docker daemon
+// fails, it is retried with an exponential backoff, and all services are resynchronised once it succeeds.
+func (m ServiceMonitor) monitor(ctx context.Context, output chan<- ContainerEvent) {
+	known := make(map[string]Container)
+	retry(ctx, "services", m.minBackoff, m.maxBackoff, func() (bool, error) {
+		return m.watch(ctx, output, known)
+	})
+}
+
+// watch connects to the Docker event stream, publishes all existing services, and then publishes events until
+// an error occurs. Returns whether the connection was successfully established, and the error that ended it.
+func (m ServiceMonitor) watch(ctx context.Context, output chan<- ContainerEvent, known map[string]Container) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, errors := m.startEventStream(ctx)
+	ticker := time.NewTicker(durationOrDefault(m.resyncInterval, defaultResyncInterval))
+	defer ticker.Stop()
+
+	if err := m.publishExistingServices(ctx, output, known); err != nil {
+		return false, err
+	}
+
+	for {
+		select {
+		case event := <-stream:
+			if event.Action == "remove" {
+				delete(known, event.Actor.ID)
+				send(ctx, output, ContainerEvent{
+					Operation: Removed,
+					Container: Container{
+						Id: event.Actor.ID,
+					},
+				})
+			} else {
+				services, err := m.listServices(ctx, filters.NewArgs(filters.Arg("id", event.Actor.ID)))
+				if err != nil {
+					return true, err
+				}
+
+				for i := range services {
+					// The ID filter matches prefixes, so make sure we only publish the service we were told about.
+					if services[i].Id == event.Actor.ID {
+						publishContainer(ctx, output, known, services[i])
+					}
+				}
+			}
+
+		case err := <-errors:
+			return true, err
+
+		case <-ticker.C:
+			if err := m.publishExistingServices(ctx, output, known); err != nil {
+				return true, err
+			}
+
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+}
+
+func (m ServiceMonitor) startEventStream(ctx context.Context) (<-chan events.Message, <-chan error) {
+	args := filters.NewArgs()
+	args.Add("type", "service")
+	for _, event := range []string{"create", "update", "remove"} {
+		args.Add("event", event)
+	}
+	return m.client.Events(ctx, types.EventsOptions{Filters: args})
+}
+
+// publishExistingServices compares the services that currently exist with the known services, and sends Added,
+// Changed and Removed events for any differences.
+func (m ServiceMonitor) publishExistingServices(ctx context.Context, output chan<- ContainerEvent, known map[string]Container) error {
+	services, err := m.listServices(ctx, filters.NewArgs())
+	if err != nil {
+		return err
+	}
+
+	publishAll(ctx, output, known, services)
+	return nil
+}
+
+// listServices returns a container describing each service matching the given filters.
+func (m ServiceMonitor) listServices(ctx context.Context, args filters.Args) ([]Container, error) {
+	services, err := m.client.ServiceList(ctx, types.ServiceListOptions{Filters: args, Status: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %s", err.Error())
+	}
+
+	var containers []Container
+	for i := range services {
+		containers = append(containers, containerFromService(&services[i]))
+	}
+	return containers, nil
+}
+
+// containerFromService describes the given service as a container. Labels on the service take precedence over
+// labels defined on its containers.
+func containerFromService(service *swarm.Service) Container {
+	labels := make(map[string]string)
+	if spec := service.Spec.TaskTemplate.ContainerSpec; spec != nil {
+		for k, v := range spec.Labels {
+			labels[k] = v
+		}
+	}
+	for k, v := range service.Spec.Labels {
+		labels[k] = v
+	}
+
+	name := service.Spec.Name
+	if service.Spec.EndpointSpec != nil && service.Spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR {
+		name = "tasks." + name
+	}
+
+	state := serviceStateNoTasks
+	if service.ServiceStatus != nil && service.ServiceStatus.RunningTasks > 0 {
+		state = StateRunning
+	}
+
+	// Ports in the service's endpoint are all published, and published ports aren't used for standalone
+	// containers either, so the port must always be given in a label.
+	return Container{
+		Id:     service.ID,
+		Name:   name,
+		Labels: labels,
+		State:  state,
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeService(id, name string, running uint64, labels map[string]string) swarm.Service {
+	return swarm.Service{
+		ID: id,
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: name, Labels: labels},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{Labels: map[string]string{labelProxy: "8080"}},
+			},
+		},
+		ServiceStatus: &swarm.ServiceStatus{RunningTasks: running, DesiredTasks: running},
+	}
+}
+
+func Test_containerFromService(t *testing.T) {
+	tests := []struct {
+		name    string
+		service swarm.Service
+		want    Container
+	}{
+		{
+			name:    "virtual IP",
+			service: fakeService("s1", "web", 2, map[string]string{labelVhost: "example.com"}),
+			want: Container{
+				Id:     "s1",
+				Name:   "web",
+				Labels: map[string]string{labelVhost: "example.com", labelProxy: "8080"},
+				State:  StateRunning,
+			},
+		},
+		{
+			name: "DNS round robin",
+			service: func() swarm.Service {
+				s := fakeService("s2", "web", 1, nil)
+				s.Spec.EndpointSpec = &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR}
+				return s
+			}(),
+			want: Container{
+				Id:     "s2",
+				Name:   "tasks.web",
+				Labels: map[string]string{labelProxy: "8080"},
+				State:  StateRunning,
+			},
+		},
+		{
+			name:    "service labels take precedence",
+			service: fakeService("s3", "web", 1, map[string]string{labelProxy: "80"}),
+			want: Container{
+				Id:     "s3",
+				Name:   "web",
+				Labels: map[string]string{labelProxy: "80"},
+				State:  StateRunning,
+			},
+		},
+		{
+			name:    "no running tasks",
+			service: fakeService("s4", "web", 0, nil),
+			want: Container{
+				Id:     "s4",
+				Name:   "web",
+				Labels: map[string]string{labelProxy: "8080"},
+				State:  serviceStateNoTasks,
+			},
+		},
+		{
+			name: "published ports are ignored",
+			service: func() swarm.Service {
+				s := fakeService("s5", "web", 1, nil)
+				s.Endpoint.Ports = []swarm.PortConfig{
+					{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 443, PublishedPort: 8443},
+					{Protocol: swarm.PortConfigProtocolUDP, TargetPort: 53, PublishedPort: 53},
+					{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 80, PublishedPort: 8080},
+				}
+				return s
+			}(),
+			want: Container{
+				Id:     "s5",
+				Name:   "web",
+				Labels: map[string]string{labelProxy: "8080"},
+				State:  StateRunning,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, containerFromService(&tt.service))
+		})
+	}
+}
+
+func Test_ServiceMonitor_events(t *testing.T) {
+	client := newFakeDockerClient()
+	client.services = []swarm.Service{fakeService("s1", "web", 1, map[string]string{labelVhost: "example.com"})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ServiceMonitor{client: client}.monitor(ctx, output)
+
+	event := receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "web", event.Container.Name)
+	assert.Equal(t, "example.com", event.Container.Labels[labelVhost])
+
+	client.mutex.Lock()
+	client.services = append(client.services, fakeService("s2", "api", 1, map[string]string{labelVhost: "api.example.com"}))
+	client.mutex.Unlock()
+	client.events <- events.Message{Type: events.ServiceEventType, Action: "create", Actor: events.Actor{ID: "s2"}}
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Added), event.Operation)
+	assert.Equal(t, "api", event.Container.Name)
+
+	client.mutex.Lock()
+	client.services[1] = fakeService("s2", "api", 0, map[string]string{labelVhost: "api.example.com"})
+	client.mutex.Unlock()
+	client.events <- events.Message{Type: events.ServiceEventType, Action: "update", Actor: events.Actor{ID: "s2"}}
+
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Changed), event.Operation)
+	assert.Equal(t, serviceStateNoTasks, event.Container.State)
+
+	client.events <- events.Message{Type: events.ServiceEventType, Action: "remove", Actor: events.Actor{ID: "s1"}}
+	event = receiveEvent(t, output)
+	assert.Equal(t, Operation(Removed), event.Operation)
+	assert.Equal(t, "s1", event.Container.Id)
+}
+
+func Test_ServiceMonitor_withContainerMonitor(t *testing.T) {
+	client := newFakeDockerClient()
+	client.services = []swarm.Service{fakeService("s1", "web", 1, map[string]string{labelVhost: "example.com"})}
+	client.containers = []types.Container{
+		{ID: "task", Names: []string{"/web.1.abc"}, State: StateRunning, Labels: map[string]string{labelSwarmServiceId: "s1", labelProxy: "8080"}},
+		{ID: "db", Names: []string{"/db"}, State: StateRunning},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := make(chan ContainerEvent)
+	go ContainerMonitor{client: client, ignoreSwarmTasks: true}.monitor(ctx, output)
+	go ServiceMonitor{client: client}.monitor(ctx, output)
+
+	// The service and the standalone container are published, but not the service's task
+	names := []string{receiveEvent(t, output).Container.Name, receiveEvent(t, output).Container.Name}
+	assert.ElementsMatch(t, []string{"web", "db"}, names)
+
+	select {
+	case event := <-output:
+		require.FailNow(t, "Unexpected event", "%v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
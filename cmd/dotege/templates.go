@@ -1,34 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
-	"sort"
+	"path/filepath"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
-var templateFuncs = template.FuncMap{
-	"replace": func(from, to, input string) string { return strings.Replace(input, from, to, -1) },
-	"split":   func(sep, input string) []string { return strings.Split(input, sep) },
-	"join":    func(sep string, input []string) string { return strings.Join(input, sep) },
-	"sortlines": func(input string) string {
-		lines := strings.Split(input, "\n")
-		sort.Strings(lines)
-		return strings.Join(lines, "\n")
-	},
-}
-
 type Template struct {
 	source      string
 	destination string
+	partials    []string
+	signals     []ContainerSignal
+	validator   Validator
 	content     string
 	template    *template.Template
+	// previous is the version of the template in use before it was last reloaded, until the new version has been
+	// executed successfully.
+	previous *template.Template
+
+	statusMutex sync.Mutex
+	status      TemplateStatus
 }
 
-func CreateTemplate(source, destination string) *Template {
+// TemplateStatus describes the outcome of the most recent attempt to generate a template.
+type TemplateStatus struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	LastRender  time.Time `json:"lastRender"`
+	LastUpdate  time.Time `json:"lastUpdate"`
+	Error       string    `json:"error,omitempty"`
+	// ParseError is set if the template source has changed but couldn't be parsed, or failed the first time it was
+	// executed. The previous version of the template continues to be used.
+	ParseError string `json:"parseError,omitempty"`
+}
+
+// CreateTemplate parses the template at source, along with any partial templates matching the given paths. Paths
+// may be files, directories or globs.
+func CreateTemplate(source, destination string, partials []string, signals []ContainerSignal, validator Validator) *Template {
 	loggers.main.Infof("Registered template from %s, writing to %s", source, destination)
-	tmpl, err := template.New(path.Base(source)).Funcs(templateFuncs).ParseFiles(source)
+	tmpl, err := parseTemplate(source, partials)
 	if err != nil {
 		loggers.main.Fatal("Unable to parse template", err)
 	}
@@ -37,32 +55,288 @@ func CreateTemplate(source, destination string) *Template {
 	return &Template{
 		source:      source,
 		destination: destination,
+		partials:    partials,
+		signals:     signals,
+		validator:   validator,
 		content:     string(buf),
 		template:    tmpl,
+		status:      TemplateStatus{Source: source, Destination: destination},
+	}
+}
+
+// parseTemplate reads and parses the template at the given path, and then any partial templates. Blocks defined in
+// the partials replace any with the same name in the main template.
+func parseTemplate(source string, partials []string) (*template.Template, error) {
+	tmpl, err := template.New(path.Base(source)).Funcs(templateFuncs).ParseFiles(source)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := expandPaths(partials)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// Partials are named after their full path, so they can't clash with the main template.
+		if _, err := tmpl.New(file).Parse(string(buf)); err != nil {
+			return nil, err
+		}
 	}
+	return tmpl, nil
+}
+
+// expandPaths returns all the files matching the given paths. Directories are expanded to all the files they
+// directly contain (other than hidden files), and globs to all of their matches.
+func expandPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(p, entry.Name()))
+				}
+			}
+		} else if isGlob(p) {
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		} else {
+			files = append(files, p)
+		}
+	}
+	return files, nil
+}
+
+// expandTemplateConfig returns a config for each template described by the given config. If its source is a
+// directory (in which case only ".tpl" files are used) or glob then each matching file is a separate template,
+// written to the destination directory with any ".tpl" extension removed.
+func expandTemplateConfig(config TemplateConfig) ([]TemplateConfig, error) {
+	info, err := os.Stat(config.Source)
+	isDir := err == nil && info.IsDir()
+	if err == nil && !isDir || err != nil && !isGlob(config.Source) {
+		// A single file, or a missing one which will be reported when it's parsed.
+		return []TemplateConfig{config}, nil
+	}
+
+	sources, err := expandPaths([]string{config.Source})
+	if err != nil {
+		return nil, err
+	}
+
+	if isDir {
+		var templates []string
+		for _, source := range sources {
+			if strings.HasSuffix(source, ".tpl") {
+				templates = append(templates, source)
+			}
+		}
+		sources = templates
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no templates found matching %s", config.Source)
+	}
+
+	var configs []TemplateConfig
+	for _, source := range sources {
+		c := config
+		c.Source = source
+		c.Destination = filepath.Join(config.Destination, strings.TrimSuffix(filepath.Base(source), ".tpl"))
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// isGlob determines whether the given path contains any glob patterns.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// files returns the paths of the template's source and all of its partials.
+func (t *Template) files() []string {
+	files, err := expandPaths(t.partials)
+	if err != nil {
+		loggers.main.Warnf("Unable to find partials for template %s: %v", t.source, err)
+	}
+	return append([]string{t.source}, files...)
+}
+
+// Reload parses the template's source again. If it can't be parsed, the previous version continues to be used and
+// the error is recorded in the template's status. The previous version is also kept until the new one has been
+// executed successfully, in case it fails when it's first executed.
+func (t *Template) Reload() error {
+	tmpl, err := parseTemplate(t.source, t.partials)
+
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	if err != nil {
+		metrics.templateParseFailures.Inc("template", t.destination)
+		t.status.ParseError = err.Error()
+		return err
+	}
+
+	if t.previous == nil {
+		t.previous = t.template
+	}
+	t.template = tmpl
+	t.status.ParseError = ""
+	return nil
+}
+
+// execute runs the template with the given context. If the template has been reloaded and the new version fails,
+// the previous version is restored and used instead, with the failure recorded in the template's status.
+func (t *Template) execute(context interface{}) (string, error) {
+	builder := &strings.Builder{}
+	err := t.template.Execute(builder, context)
+	if err == nil || t.previous == nil {
+		t.previous = nil
+		return builder.String(), err
+	}
+
+	loggers.main.Errorf("Reloaded template %s failed, restoring previous version: %v", t.source, err)
+	metrics.templateExecuteFailures.Inc("template", t.destination)
+	t.statusMutex.Lock()
+	t.status.ParseError = err.Error()
+	t.statusMutex.Unlock()
+
+	t.template = t.previous
+	t.previous = nil
+	builder.Reset()
+	err = t.template.Execute(builder, context)
+	return builder.String(), err
 }
 
 type Templates []*Template
 
-func (t Templates) Generate(context interface{}) (updated bool) {
+// Watch sends templates to the given channel whenever their source files or partials change, until the context
+// is cancelled. Partials added after Watch is called aren't watched.
+func (t Templates) Watch(ctx context.Context, changes chan<- *Template) error {
+	users := make(map[string]Templates)
+	var files []string
+	for i := range t {
+		for _, file := range t[i].files() {
+			if _, ok := users[file]; !ok {
+				files = append(files, file)
+			}
+			users[file] = append(users[file], t[i])
+		}
+	}
+
+	for i := range files {
+		file := files[i]
+		err := watchFile(ctx, file, func() {
+			loggers.main.Infof("Template source %s changed", file)
+			for _, tmpl := range users[file] {
+				select {
+				case changes <- tmpl:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("unable to watch template %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// Generate executes all templates with the given context, writing any that have changed to disk. The templates
+// that were changed are returned.
+func (t Templates) Generate(context interface{}) (updated Templates) {
 	for _, tmpl := range t {
 		loggers.main.Debugf("Checking for updates to %s", tmpl.source)
-		builder := &strings.Builder{}
-		err := tmpl.template.Execute(builder, context)
+		output, err := tmpl.execute(context)
+		now := time.Now()
 		if err != nil {
-			panic(err)
+			loggers.main.Errorf("Unable to execute template %s, keeping previous output: %s", tmpl.source, err.Error())
+			metrics.templateExecuteFailures.Inc("template", tmpl.destination)
+			tmpl.updateStatus(now, false, err)
+			continue
 		}
-		if tmpl.content != builder.String() {
-			updated = true
+
+		metrics.templateRenders.Inc("template", tmpl.destination)
+		metrics.templateLastRender.Set(float64(now.Unix()), "template", tmpl.destination)
+		if tmpl.content != output {
 			loggers.main.Infof("Writing updated template to %s", tmpl.destination)
-			tmpl.content = builder.String()
-			err = ioutil.WriteFile(tmpl.destination, []byte(builder.String()), 0666)
-			if err != nil {
-				loggers.main.Fatal("Unable to write template", err)
+			err = writeFileAtomic(tmpl.destination, []byte(output), 0666, tmpl.validate)
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				loggers.main.Errorf("Generated template for %s is invalid, keeping previous version: %s", tmpl.destination, err.Error())
+				metrics.templateValidationFailures.Inc("template", tmpl.destination)
+				tmpl.updateStatus(now, false, err)
+				continue
+			} else if err != nil {
+				loggers.main.Errorf("Unable to write template to %s: %s", tmpl.destination, err.Error())
+				metrics.templateWriteFailures.Inc("template", tmpl.destination)
+				tmpl.updateStatus(now, false, err)
+				continue
 			}
+			tmpl.content = output
+			tmpl.updateStatus(now, true, nil)
+			updated = append(updated, tmpl)
 		} else {
+			tmpl.updateStatus(now, false, nil)
 			loggers.main.Debugf("Not writing template to %s as content is the same", tmpl.destination)
 		}
 	}
 	return
 }
+
+// updateStatus records the outcome of generating the template.
+func (t *Template) updateStatus(rendered time.Time, updated bool, err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+
+	t.status.LastRender = rendered
+	if updated {
+		t.status.LastUpdate = rendered
+	}
+
+	t.status.Error = ""
+	if err != nil {
+		t.status.Error = err.Error()
+	}
+}
+
+// Status returns the outcome of the most recent attempt to generate the template.
+func (t *Template) Status() TemplateStatus {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	return t.status
+}
+
+// validate checks the generated output at the given path using the template's validator, if it has one.
+func (t *Template) validate(path string) error {
+	if t.validator == nil {
+		return nil
+	}
+	return t.validator.Validate(path)
+}
+
+// Signals returns the signals that should be sent when any of the templates change. Templates that don't have any
+// signals configured use the given fallback.
+func (t Templates) Signals(fallback []ContainerSignal) []ContainerSignal {
+	var signals []ContainerSignal
+	for _, tmpl := range t {
+		if len(tmpl.signals) > 0 {
+			signals = append(signals, tmpl.signals...)
+		} else {
+			signals = append(signals, fallback...)
+		}
+	}
+	return signals
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// bundledTemplateData returns a fixed set of data exercising most features of the bundled templates.
+func bundledTemplateData() TemplateData {
+	containers := Containers{
+		"web": {Id: "web", Name: "web", State: StateRunning, Labels: map[string]string{
+			labelVhost:                        "example.com, www.example.com",
+			labelProxy:                        "8080",
+			labelHeaders + ".X-Frame-Options": "X-Frame-Options: DENY",
+			labelHeaders + ".Csp":             `Content-Security-Policy: default-src 'self' "$host"`,
+		}},
+		"api1": {Id: "api1", Name: "api_1", State: StateRunning, Labels: map[string]string{
+			labelVhost:   "example.com/api",
+			labelProxy:   "3000",
+			labelBalance: "leastconn",
+			labelAuth:    "",
+		}},
+		"api2": {Id: "api2", Name: "api_2", State: StateRunning, Labels: map[string]string{
+			labelVhost:  "example.com/api",
+			labelProxy:  "3000",
+			labelWeight: "50",
+			labelAuth:   "",
+		}},
+		"admin": {Id: "admin", Name: "admin", State: StateRunning, Labels: map[string]string{
+			labelVhost:     "admin-panel.example.com",
+			labelProxy:     "80",
+			labelAuth:      "admins",
+			labelBackup:    "false",
+			labelTLSALPN:   "http/1.1",
+			labelTLSVerify: "required",
+			labelTLSCA:     "/certs/clients.pem",
+			labelTLSMinVer: "TLSv1.3",
+		}},
+		"static": {Id: "static", Name: "static", State: StateRunning, Labels: map[string]string{
+			labelVhost: "static.example.org",
+		}},
+	}
+
+	hostnames := containers.Hostnames(false)
+	for _, name := range []string{"example.com", "admin-panel.example.com"} {
+		hostnames[name].CertificateFile = "/data/certs/" + name + ".pem"
+		hostnames[name].KeyFile = "/data/certs/" + name + ".key"
+	}
+
+	users := []User{
+		{Name: "chris", Password: "$6$salt$hash1", Groups: []string{"admins"}},
+		{Name: "bob", Password: "$6$salt$hash2"},
+	}
+
+	return TemplateData{
+		Containers:      containers,
+		Hostnames:       hostnames,
+		Groups:          groups(users),
+		Users:           users,
+		AcmeHttpBackend: "acme:8080",
+	}
+}
+
+func Test_bundledTemplates(t *testing.T) {
+	for _, name := range []string{"haproxy.cfg", "domains.txt", "nginx.conf", "htpasswd", "traefik.yml", "Caddyfile", "crt-list.txt"} {
+		t.Run(name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), name)
+			tpl := CreateTemplate(filepath.Join("../../templates", name+".tpl"), output, nil, nil, nil)
+			Templates{tpl}.Generate(bundledTemplateData())
+
+			actual, err := os.ReadFile(output)
+			require.NoError(t, err)
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, actual, 0644))
+			}
+
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), string(actual))
+		})
+	}
+}
+
+func Test_Templates_Generate_returnsUpdatedTemplates(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.tpl"), []byte("{{ .A }}"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.tpl"), []byte("{{ .B }}"), 0600))
+
+	a := CreateTemplate(filepath.Join(dir, "a.tpl"), filepath.Join(dir, "a.out"), nil, nil, nil)
+	b := CreateTemplate(filepath.Join(dir, "b.tpl"), filepath.Join(dir, "b.out"), nil, nil, nil)
+	templates := Templates{a, b}
+
+	assert.Equal(t, Templates{a, b}, templates.Generate(map[string]string{"A": "1", "B": "1"}))
+	assert.Empty(t, templates.Generate(map[string]string{"A": "1", "B": "1"}))
+	assert.Equal(t, Templates{b}, templates.Generate(map[string]string{"A": "1", "B": "2"}))
+
+	buf, err := os.ReadFile(filepath.Join(dir, "b.out"))
+	require.NoError(t, err)
+	assert.Equal(t, "2", string(buf))
+}
+
+func Test_Templates_Signals(t *testing.T) {
+	fallback := []ContainerSignal{{Name: "haproxy", Signal: "USR2"}}
+	own := []ContainerSignal{{Name: "dehydrated", Signal: "HUP"}}
+
+	tests := []struct {
+		name      string
+		templates Templates
+		want      []ContainerSignal
+	}{
+		{"no templates", Templates{}, nil},
+		{"template without signals", Templates{{}}, fallback},
+		{"template with signals", Templates{{signals: own}}, own},
+		{"mixed", Templates{{signals: own}, {}}, append(append([]ContainerSignal{}, own...), fallback...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.templates.Signals(fallback))
+		})
+	}
+}
+
+func Test_HAProxyTemplate_replicas(t *testing.T) {
+	dir := t.TempDir()
+	tpl := CreateTemplate("../../templates/haproxy.cfg.tpl", filepath.Join(dir, "haproxy.cfg"), nil, nil, nil)
+
+	labels := map[string]string{labelVhost: "example.com", labelProxy: "80", labelBalance: "leastconn"}
+	containers := Containers{
+		"a": {Id: "a", Name: "web_1", State: StateRunning, Labels: labels},
+		"b": {Id: "b", Name: "web_2", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80", labelWeight: "50"}},
+		"c": {Id: "c", Name: "web_3", State: StateRunning, Labels: map[string]string{labelVhost: "example.com", labelProxy: "80", labelBackup: "true"}},
+	}
+
+	Templates{tpl}.Generate(TemplateData{Containers: containers, Hostnames: containers.Hostnames(false)})
+
+	buf, err := os.ReadFile(filepath.Join(dir, "haproxy.cfg"))
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "backend example_com\n    mode http\n    balance leastconn\n")
+	assert.Contains(t, string(buf), ""+
+		"    server web_1 web_1:80\n"+
+		"    server web_2 web_2:80 weight 50\n"+
+		"    server web_3 web_3:80 backup\n")
+}
+
+func Test_Template_Reload(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.tpl")
+	require.NoError(t, os.WriteFile(source, []byte("first {{ . }}"), 0600))
+
+	tpl := CreateTemplate(source, filepath.Join(dir, "out"), nil, nil, nil)
+	templates := Templates{tpl}
+
+	require.NoError(t, os.WriteFile(source, []byte("second {{ ."), 0600))
+	assert.Error(t, tpl.Reload())
+	assert.NotEmpty(t, tpl.Status().ParseError)
+
+	// The previous version is kept
+	templates.Generate("data")
+	buf, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "first data", string(buf))
+
+	require.NoError(t, os.WriteFile(source, []byte("third {{ . }}"), 0600))
+	assert.NoError(t, tpl.Reload())
+	assert.Empty(t, tpl.Status().ParseError)
+
+	templates.Generate("data")
+	buf, err = os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "third data", string(buf))
+}
+
+func Test_Template_Reload_executeError(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.tpl")
+	require.NoError(t, os.WriteFile(source, []byte("first {{ . }}"), 0600))
+
+	tpl := CreateTemplate(source, filepath.Join(dir, "out"), nil, nil, nil)
+	templates := Templates{tpl}
+
+	// The new version parses, but fails when executed, so the previous version is restored
+	require.NoError(t, os.WriteFile(source, []byte("second {{ div 1 0 }}"), 0600))
+	require.NoError(t, tpl.Reload())
+	assert.Len(t, templates.Generate("data"), 1)
+	assert.Contains(t, tpl.Status().ParseError, "division by zero")
+	assert.Empty(t, tpl.Status().Error)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "first data", string(buf))
+
+	assert.Empty(t, templates.Generate("more data")[0].Status().Error)
+	buf, err = os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "first more data", string(buf))
+}
+
+func Test_Templates_Generate_executeError(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.tpl")
+	require.NoError(t, os.WriteFile(source, []byte("{{ div 10 . }}"), 0600))
+
+	tpl := CreateTemplate(source, filepath.Join(dir, "out"), nil, nil, nil)
+	templates := Templates{tpl}
+	assert.Len(t, templates.Generate(2), 1)
+
+	// Executing fails, but the process carries on and the previous output is kept
+	assert.Empty(t, templates.Generate(0))
+	assert.Contains(t, tpl.Status().Error, "division by zero")
+
+	buf, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "5", string(buf))
+
+	assert.Len(t, templates.Generate(5), 1)
+	assert.Empty(t, tpl.Status().Error)
+}
+
+func Test_HAProxyTemplate_overrideBlock(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "defaults.tpl")
+	require.NoError(t, os.WriteFile(partial, []byte(`{{ define "defaults" }}defaults
+    mode http
+    timeout client 1h
+{{- end }}`), 0600))
+
+	tpl := CreateTemplate("../../templates/haproxy.cfg.tpl", filepath.Join(dir, "haproxy.cfg"), []string{partial}, nil, nil)
+	Templates{tpl}.Generate(TemplateData{})
+
+	buf, err := os.ReadFile(filepath.Join(dir, "haproxy.cfg"))
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "\n\ndefaults\n    mode http\n    timeout client 1h\n\nfrontend main\n")
+	assert.Contains(t, string(buf), "resolvers docker_resolver\n")
+	assert.NotContains(t, string(buf), "timeout client 30000")
+}
+
+func Test_Template_partials(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "main.tpl")
+	require.NoError(t, os.WriteFile(source, []byte(`{{ block "greeting" . }}Hello{{ end }}, {{ template "name" . }}`), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "partials"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "partials", "name.tpl"), []byte(`{{ define "name" }}{{ . }}{{ end }}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "greeting.tpl"), []byte(`{{ define "greeting" }}Goodbye{{ end }}`), 0600))
+
+	// Partials with the same name as the main template don't replace it
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "partials", "main.tpl"), []byte(`ignored`), 0600))
+
+	tpl := CreateTemplate(source, filepath.Join(dir, "out"), []string{filepath.Join(dir, "partials"), filepath.Join(dir, "greet*.tpl")}, nil, nil)
+	Templates{tpl}.Generate("world")
+
+	buf, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "Goodbye, world", string(buf))
+}
+
+func Test_Templates_Watch_partials(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "partial.tpl")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.tpl"), []byte(`a {{ template "p" }}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.tpl"), []byte(`b {{ template "p" }}`), 0600))
+	require.NoError(t, os.WriteFile(partial, []byte(`{{ define "p" }}1{{ end }}`), 0600))
+
+	a := CreateTemplate(filepath.Join(dir, "a.tpl"), filepath.Join(dir, "a.out"), []string{partial}, nil, nil)
+	b := CreateTemplate(filepath.Join(dir, "b.tpl"), filepath.Join(dir, "b.out"), []string{partial}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan *Template)
+	require.NoError(t, Templates{a, b}.Watch(ctx, changes))
+
+	require.NoError(t, os.WriteFile(partial, []byte(`{{ define "p" }}2{{ end }}`), 0600))
+
+	var changed Templates
+	for i := 0; i < 2; i++ {
+		select {
+		case tmpl := <-changes:
+			changed = append(changed, tmpl)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "Timed out waiting for template change")
+		}
+	}
+	assert.ElementsMatch(t, Templates{a, b}, changed)
+}
+
+func Test_expandTemplateConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "templates"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "haproxy.cfg.tpl"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "domains.txt.tpl"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "README"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", ".hidden"), nil, 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "templates", "partials"), 0700))
+
+	signals := []ContainerSignal{{Name: "haproxy", Signal: "USR2"}}
+	tests := []struct {
+		name    string
+		source  string
+		want    []TemplateConfig
+		wantErr bool
+	}{
+		{
+			name:   "file",
+			source: filepath.Join(dir, "templates", "haproxy.cfg.tpl"),
+			want:   []TemplateConfig{{Source: filepath.Join(dir, "templates", "haproxy.cfg.tpl"), Destination: "/out", Signals: signals}},
+		},
+		{
+			name:   "missing file",
+			source: filepath.Join(dir, "missing.tpl"),
+			want:   []TemplateConfig{{Source: filepath.Join(dir, "missing.tpl"), Destination: "/out", Signals: signals}},
+		},
+		{
+			name:   "directory",
+			source: filepath.Join(dir, "templates"),
+			want: []TemplateConfig{
+				{Source: filepath.Join(dir, "templates", "domains.txt.tpl"), Destination: "/out/domains.txt", Signals: signals},
+				{Source: filepath.Join(dir, "templates", "haproxy.cfg.tpl"), Destination: "/out/haproxy.cfg", Signals: signals},
+			},
+		},
+		{
+			name:   "glob",
+			source: filepath.Join(dir, "templates", "*.tpl"),
+			want: []TemplateConfig{
+				{Source: filepath.Join(dir, "templates", "domains.txt.tpl"), Destination: "/out/domains.txt", Signals: signals},
+				{Source: filepath.Join(dir, "templates", "haproxy.cfg.tpl"), Destination: "/out/haproxy.cfg", Signals: signals},
+			},
+		},
+		{
+			name:    "no matches",
+			source:  filepath.Join(dir, "templates", "*.yml"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandTemplateConfig(TemplateConfig{Source: tt.source, Destination: "/out", Signals: signals})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_Templates_Generate_validation(t *testing.T) {
+	dir := t.TempDir()
+	destination := filepath.Join(dir, "out")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.tpl"), []byte("{{ . }}"), 0600))
+
+	var validated []string
+	tpl := CreateTemplate(filepath.Join(dir, "a.tpl"), destination, nil, nil, validatorFunc(func(path string) error {
+		buf, err := os.ReadFile(path)
+		require.NoError(t, err)
+		validated = append(validated, string(buf))
+		if string(buf) == "bad" {
+			return &ValidationError{assert.AnError}
+		}
+		return nil
+	}))
+	templates := Templates{tpl}
+
+	assert.Equal(t, Templates{tpl}, templates.Generate("good"))
+	assert.Empty(t, templates.Generate("bad"))
+
+	// The last good output is kept, and no temporary files are left around
+	buf, err := os.ReadFile(destination)
+	require.NoError(t, err)
+	assert.Equal(t, "good", string(buf))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Invalid output is retried the next time the template is generated
+	assert.Empty(t, templates.Generate("bad"))
+	assert.Equal(t, Templates{tpl}, templates.Generate("better"))
+	assert.Equal(t, []string{"good", "bad", "bad", "better"}, validated)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	validateFilePlaceholder = "{{file}}"
+	validateTimeout         = 30 * time.Second
+)
+
+// Validator checks that a generated file is acceptable before it replaces the previous version.
+type Validator interface {
+	Validate(path string) error
+}
+
+// ValidationError indicates that a generated file was rejected by its validator.
+type ValidationError struct {
+	err error
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("validation failed: %v", v.err)
+}
+
+func (v *ValidationError) Unwrap() error {
+	return v.err
+}
+
+// NewValidator creates a validator for the given config, or returns nil if no validation is required.
+func NewValidator(config ValidateConfig, client DockerClient) Validator {
+	if strings.TrimSpace(config.Command) == "" {
+		return nil
+	} else if config.Container != "" {
+		return &ContainerValidator{client: client, container: config.Container, command: config.Command, directory: config.Directory}
+	} else {
+		return &CommandValidator{command: config.Command}
+	}
+}
+
+// CommandValidator validates files by running a local command, which must exit successfully.
+type CommandValidator struct {
+	command string
+}
+
+func (c *CommandValidator) Validate(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+
+	args := validateArgs(c.command, path)
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return &ValidationError{fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))}
+	}
+	return nil
+}
+
+// ContainerValidator validates files by running a command in another container using docker exec. The directory
+// the file is in must be mounted in the container, either at the same path or at the given directory.
+type ContainerValidator struct {
+	client    DockerClient
+	container string
+	command   string
+	directory string
+}
+
+func (c *ContainerValidator) Validate(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+
+	if c.directory != "" {
+		path = filepath.Join(c.directory, filepath.Base(path))
+	}
+
+	exec, err := c.client.ContainerExecCreate(ctx, c.container, types.ExecConfig{
+		Cmd:          validateArgs(c.command, path),
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create exec in container %s: %w", c.container, err)
+	}
+
+	response, err := c.client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return fmt.Errorf("unable to start exec in container %s: %w", c.container, err)
+	}
+	defer response.Close()
+
+	output := &bytes.Buffer{}
+	if _, err := stdcopy.StdCopy(output, output, response.Reader); err != nil {
+		return fmt.Errorf("unable to read output of exec in container %s: %w", c.container, err)
+	}
+
+	for {
+		inspect, err := c.client.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return fmt.Errorf("unable to inspect exec in container %s: %w", c.container, err)
+		}
+
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return &ValidationError{fmt.Errorf("exit code %d: %s", inspect.ExitCode, strings.TrimSpace(output.String()))}
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// validateArgs splits the command into arguments, replacing the file placeholder with the given path. Commands are
+// not run through a shell, so quoting is not supported.
+func validateArgs(command, path string) []string {
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], validateFilePlaceholder, path)
+	}
+	return args
+}
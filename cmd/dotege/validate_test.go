@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validatorFunc adapts a function into a Validator.
+type validatorFunc func(path string) error
+
+func (v validatorFunc) Validate(path string) error {
+	return v(path)
+}
+
+func Test_validateArgs(t *testing.T) {
+	assert.Equal(t, []string{"haproxy", "-c", "-f", "/tmp/x.cfg"}, validateArgs("haproxy -c -f {{file}}", "/tmp/x.cfg"))
+	assert.Equal(t, []string{"nginx", "-t", "-c/tmp/x.cfg"}, validateArgs("  nginx -t  -c{{file}} ", "/tmp/x.cfg"))
+}
+
+func Test_NewValidator(t *testing.T) {
+	assert.Nil(t, NewValidator(ValidateConfig{}, nil))
+	assert.Nil(t, NewValidator(ValidateConfig{Command: "  "}, nil))
+	assert.IsType(t, &CommandValidator{}, NewValidator(ValidateConfig{Command: "true"}, nil))
+	assert.IsType(t, &ContainerValidator{}, NewValidator(ValidateConfig{Command: "true", Container: "haproxy"}, nil))
+}
+
+func Test_CommandValidator(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	bad := filepath.Join(dir, "bad")
+	require.NoError(t, os.WriteFile(good, []byte("valid\n"), 0600))
+	require.NoError(t, os.WriteFile(bad, []byte("nope\n"), 0600))
+
+	v := &CommandValidator{command: "grep -q valid {{file}}"}
+	assert.NoError(t, v.Validate(good))
+
+	err := v.Validate(bad)
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+}
+
+func Test_ContainerValidator(t *testing.T) {
+	client := newFakeDockerClient()
+	var commands [][]string
+	client.exec = func(container string, cmd []string) (string, int) {
+		assert.Equal(t, "haproxy", container)
+		commands = append(commands, cmd)
+		if cmd[len(cmd)-1] == "/usr/local/etc/haproxy/.haproxy.cfg.tmp-bad" {
+			return "[ALERT] config : parsing error\n", 1
+		}
+		return "Configuration file is valid\n", 0
+	}
+
+	v := &ContainerValidator{client: client, container: "haproxy", command: "haproxy -c -f {{file}}", directory: "/usr/local/etc/haproxy"}
+	assert.NoError(t, v.Validate("/data/output/.haproxy.cfg.tmp-good"))
+
+	err := v.Validate("/data/output/.haproxy.cfg.tmp-bad")
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Contains(t, err.Error(), "parsing error")
+
+	assert.Equal(t, [][]string{
+		{"haproxy", "-c", "-f", "/usr/local/etc/haproxy/.haproxy.cfg.tmp-good"},
+		{"haproxy", "-c", "-f", "/usr/local/etc/haproxy/.haproxy.cfg.tmp-bad"},
+	}, commands)
+}
+
+func Test_ContainerValidator_missingContainer(t *testing.T) {
+	v := &ContainerValidator{client: newFakeDockerClient(), container: "haproxy", command: "haproxy -c -f {{file}}"}
+	err := v.Validate("/data/output/haproxy.cfg")
+	assert.Error(t, err)
+
+	var validationErr *ValidationError
+	assert.False(t, errors.As(err, &validationErr))
+}
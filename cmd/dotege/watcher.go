@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettleTime is how long to wait after a file changes before reading it.
+const watchSettleTime = 100 * time.Millisecond
+
+// watchFile calls onChange whenever the content of the file at the given path changes, until the context is
+// cancelled. The file's directory is watched rather than the file itself, so that files which are replaced rather
+// than modified (e.g. by editors that save atomically, or Kubernetes updating a secret) continue to be tracked.
+func watchFile(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	last := fileHash(path)
+	go func() {
+		defer watcher.Close()
+
+		// Files written in place may be seen while they're empty or partially written, so wait until events stop
+		// before reading the file.
+		settle := time.NewTimer(watchSettleTime)
+		settle.Stop()
+		defer settle.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				resetTimer(settle, watchSettleTime)
+			case <-settle.C:
+				if hash := fileHash(path); hash != last {
+					last = hash
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				loggers.main.Warnf("Error watching %s for changes: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// fileHash returns a hash of the given file's content, or an empty array if it can't be read.
+func fileHash(path string) [sha256.Size]byte {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(buf)
+}
+
+// resetTimer stops the timer, discarding any pending tick, and then restarts it with the given duration.
+func resetTimer(timer *time.Timer, duration time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(duration)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveUsers(t *testing.T, updates <-chan []User) []User {
+	select {
+	case users := <-updates:
+		return users
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for users to be reloaded")
+		return nil
+	}
+}
+
+func Test_watchUsersFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users")
+	require.NoError(t, os.WriteFile(path, []byte("chris:hash\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []User)
+	require.NoError(t, watchUsersFile(ctx, path, updates))
+
+	// Modified in place
+	require.NoError(t, os.WriteFile(path, []byte("chris:hash\nbob:hash2\n"), 0600))
+	assert.Equal(t, []User{{Name: "chris", Password: "hash"}, {Name: "bob", Password: "hash2"}}, receiveUsers(t, updates))
+
+	// Invalid content is ignored
+	require.NoError(t, os.WriteFile(path, []byte("not valid\n"), 0600))
+
+	// Replaced atomically
+	temp := filepath.Join(dir, "users.tmp")
+	require.NoError(t, os.WriteFile(temp, []byte("- name: alice\n  password: hash3\n"), 0600))
+	require.NoError(t, os.Rename(temp, path))
+	assert.Equal(t, []User{{Name: "alice", Password: "hash3"}}, receiveUsers(t, updates))
+}
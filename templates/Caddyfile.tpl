@@ -0,0 +1,100 @@
+{{- /*
+    Generates a Caddyfile serving all hostnames. Certificates are read from the paths dotege deploys them to, so
+    the certificate volume should be mounted at the same path in the Caddy container. Hostnames without a
+    deployed certificate are served over plain HTTP, rather than Caddy obtaining its own certificates.
+
+    Routes other than "/" use named matchers, so that Caddy keeps them in order from most to least specific.
+
+    Caddy doesn't support per-server weights or backup servers in reverse_proxy, so these are ignored. Basic auth
+    passwords must be hashed using bcrypt.
+
+    Each section of this template is a named block, which can be replaced by defining a block with the same
+    name in a partial template. See the README for details.
+*/ -}}
+
+{{ block "global" . -}}
+{
+	auto_https disable_certs
+}
+{{- end }}
+
+{{- block "sites" . }}
+{{- range .Hostnames }}
+{{- if .CertificateFile }}
+
+http://{{ .Name }}{{ range .Alternatives }}, http://{{ . }}{{ end }} {
+	{{- template "acme" $.AcmeHttpBackend }}
+
+	handle {
+		redir https://{host}{uri} permanent
+	}
+}
+
+{{ .Name }}{{ range .Alternatives }}, {{ . }}{{ end }} {
+	tls {{ .CertificateFile }} {{ .KeyFile }}
+	header ?Strict-Transport-Security "max-age=15768000"
+	header -Server
+{{- else }}
+
+http://{{ .Name }}{{ range .Alternatives }}, http://{{ . }}{{ end }} {
+	header -Server
+	{{- template "acme" $.AcmeHttpBackend }}
+{{- end }}
+	{{- range .Routes }}
+	{{- $group := .AuthGroup }}
+	{{- if eq .Path "/" }}
+
+	handle {
+	{{- else }}
+
+	@{{ .Name }} path {{ if hasSuffix "/" .Path }}{{ .Path }}*{{ else }}{{ .Path }} {{ .Path }}/*{{ end }}
+	handle @{{ .Name }} {
+	{{- end }}
+		{{- if .RequiresAuth }}
+		basicauth {
+			{{- range $.Users }}
+			{{- if or (not $group) (contains $group .Groups) }}
+			{{ .Name }} {{ .Password }}
+			{{- end }}
+			{{- end }}
+		}
+		{{- end }}
+		{{- range $k, $v := .Headers }}
+		header {{ $k }} {{ $v | quote }}
+		{{- end }}
+		{{- template "reverse_proxy" . }}
+	}
+	{{- end }}
+}
+{{- end }}
+{{- end }}
+
+{{- /* reverse_proxy is used for each route, with the route as its data. */ -}}
+{{- define "reverse_proxy" }}
+		{{- $proxied := false }}
+		{{- range .Containers }}{{ if .ShouldProxy }}{{ $proxied = true }}{{ end }}{{ end }}
+		{{- if $proxied }}
+		reverse_proxy {{ range .Containers }}{{ if .ShouldProxy }}{{ .Name }}:{{ .Port }} {{ end }}{{ end }}{
+			{{- if eq .Balance "leastconn" }}
+			lb_policy least_conn
+			{{- else if eq .Balance "source" }}
+			lb_policy ip_hash
+			{{- else if eq .Balance "first" }}
+			lb_policy first
+			{{- else }}
+			lb_policy round_robin
+			{{- end }}
+		}
+		{{- else }}
+		respond 502
+		{{- end }}
+{{- end }}
+
+{{- /* acme is used in each site served over HTTP, with the ACME HTTP backend (if any) as its data. */ -}}
+{{- define "acme" }}
+	{{- if . }}
+	handle /.well-known/acme-challenge/* {
+		reverse_proxy {{ . }}
+	}
+	{{- end }}
+{{- end }}
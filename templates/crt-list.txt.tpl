@@ -0,0 +1,17 @@
+{{- /*
+    Generates a crt-list for HAProxy, mapping each deployed certificate to the hostnames it's used for, along
+    with any TLS options from the hostname's com.chameth.tls.* labels. Certificates are referenced in the
+    /certs/ directory, as in haproxy.cfg.tpl. See the README for how to make HAProxy use the crt-list.
+*/ -}}
+{{- range .Hostnames }}
+{{- if .CertificateFile }}
+{{- $options := "" }}
+{{- with .TLS }}
+{{- if .ALPN }}{{ $options = printf "%s alpn %s" $options .ALPN }}{{ end }}
+{{- if .Verify }}{{ $options = printf "%s verify %s" $options .Verify }}{{ end }}
+{{- if .CAFile }}{{ $options = printf "%s ca-file %s" $options .CAFile }}{{ end }}
+{{- if .MinVersion }}{{ $options = printf "%s ssl-min-ver %s" $options .MinVersion }}{{ end }}
+{{- end -}}
+/certs/{{ .CertificateFile | base }}{{ if $options }} [{{ trim $options }}]{{ end }} {{ .Name }}{{ range .Alternatives }} {{ . }}{{ end }}
+{{ end }}
+{{- end -}}
@@ -1,3 +1,9 @@
+{{- /*
+    Each section of this template is a named block, which can be replaced by defining a block with the same
+    name in a partial template. See the README for details.
+*/ -}}
+
+{{ block "global" . -}}
 global
     ssl-default-bind-ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384
     ssl-default-bind-ciphersuites TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256
@@ -5,10 +11,14 @@ global
     ssl-default-server-ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384
     ssl-default-server-ciphersuites TLS_AES_128_GCM_SHA256:TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256
     ssl-default-server-options no-sslv3 no-tlsv10 no-tlsv11 no-tls-tickets
+{{- end }}
 
+{{ block "resolvers" . -}}
 resolvers docker_resolver
     nameserver dns 127.0.0.11:53
+{{- end }}
 
+{{ block "defaults" . -}}
 defaults
     log global
     mode    http
@@ -18,7 +28,9 @@ defaults
     compression algo gzip
     compression type text/plain text/css application/json application/javascript application/x-javascript text/xml application/xml application/xml+rss text/javascript
     default-server init-addr last,libc,none check resolvers docker_resolver
+{{- end }}
 
+{{- block "userlist" . }}
 {{- if len .Groups | lt 0 }}
 
 userlist dotege
@@ -31,35 +43,79 @@ userlist dotege
     {{- if len .Groups | lt 0 }} groups {{ .Groups | join "," }}{{ end }}
     {{- end }}
 {{- end }}
+{{- end }}
 
+{{ block "frontend" . -}}
 frontend main
     mode    http
+    {{- block "bind" . }}
     bind    :::443 v4v6 ssl strict-sni alpn h2,http/1.1 crt /certs/
     bind    :::80 v4v6
+    {{- end }}
     http-request set-header X-Forwarded-For %[src]
     http-request set-header X-Forwarded-Proto https if { ssl_fc }
+{{- if .AcmeHttpBackend }}
+    acl acme_challenge path_beg /.well-known/acme-challenge/
+    use_backend dotege_acme if acme_challenge
+    redirect scheme https code 301 if !{ ssl_fc } !acme_challenge
+{{- else }}
     redirect scheme https code 301 if !{ ssl_fc }
+{{- end }}
     http-response set-header Strict-Transport-Security max-age=15768000 if { res.fhdr_cnt(Strict-Transport-Security) 0 }
     http-response del-header Server
 {{- range .Hostnames }}
-    use_backend {{ .Name | replace "." "_" }} if { hdr(host) -i {{ .Name }}
-        {{- range .Alternatives }} || hdr(host) -i {{ . }} {{- end }} }
+    acl host_{{ identifier .Name }} hdr(host) -i {{ .Name }}
+        {{- range .Alternatives }} {{ . }}{{ end }}
+{{- end -}}
+{{- range .Hostnames }}
+    {{- $host := . }}
+    {{- $acl := printf "host_%s" (identifier $host.Name) }}
+    {{- range .Routes }}
+    use_backend {{ .Name }} if {{ $acl }}
+        {{- if ne .Path "/" }}
+        {{- if hasSuffix "/" .Path }} { path_beg {{ .Path }} }
+        {{- else }} { path {{ .Path }} } || {{ $acl }} { path_beg {{ .Path }}/ }
+        {{- end }}
+        {{- end }}
+    {{- end -}}
+{{- end -}}
+{{- end }}
+
+{{- block "backends" . }}
+{{- if .AcmeHttpBackend }}
+
+backend dotege_acme
+    mode http
+    server dotege {{ .AcmeHttpBackend }} no-check
 {{- end -}}
 
-{{ range .Hostnames }}
+{{- range .Hostnames }}
+{{- range .Routes }}
 
-backend {{ .Name | replace "." "_" }}
+{{ template "backend" . }}
+{{- end -}}
+{{- end -}}
+{{- end }}
+
+{{- /* backend is used for each route, with the route as its data. */ -}}
+{{- define "backend" -}}
+backend {{ .Name }}
     mode http
+    {{- if .Balance }}
+    balance {{ .Balance }}
+    {{- end -}}
     {{- range .Containers }}
         {{- if .ShouldProxy }}
-    server server1 {{ .Name }}:{{ .Port }}
+    server {{ .Name }} {{ .Name }}:{{ .Port }}
+            {{- if ge .Weight 0 }} weight {{ .Weight }}{{ end }}
+            {{- if .Backup }} backup{{ end }}
         {{- end -}}
     {{- end -}}
     {{- range $k, $v := .Headers }}
-    http-response set-header {{ $k }} "{{ $v | replace "\"" "\\\"" }}"
+    http-response set-header {{ $k }} {{ $v | haproxyQuote }}
     {{- end -}}
     {{- if .RequiresAuth }}
-    acl authed_{{ .Name | replace "." "_" }} http_auth(dotege) {{ .AuthGroup }}
-    http-request auth if !authed_{{ .Name | replace "." "_" }}
+    acl authed_{{ .Name }} http_auth(dotege) {{ .AuthGroup }}
+    http-request auth if !authed_{{ .Name }}
     {{- end -}}
-{{ end }}
+{{- end }}
@@ -0,0 +1,7 @@
+{{- /*
+    Writes all users in the htpasswd format, for use with nginx's auth_basic_user_file directive. Passwords must be
+    hashed using an algorithm that nginx supports, such as those produced by "openssl passwd -6".
+*/ -}}
+{{ range .Users -}}
+{{ .Name }}:{{ .Password }}
+{{ end -}}
@@ -0,0 +1,199 @@
+{{- /*
+    Generates nginx configuration for all hostnames, suitable for including in the http context (e.g. as
+    /etc/nginx/conf.d/default.conf). Certificates are read from the paths dotege deploys them to, so the
+    certificate volume should be mounted at the same path in the nginx container. Users are read from the
+    htpasswd file generated by htpasswd.tpl, which should be written to /etc/nginx/htpasswd.
+
+    Each section of this template is a named block, which can be replaced by defining a block with the same
+    name in a partial template. See the README for details.
+*/ -}}
+
+{{ block "http" . -}}
+server_tokens off;
+
+ssl_protocols TLSv1.2 TLSv1.3;
+ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384;
+ssl_prefer_server_ciphers off;
+ssl_session_tickets off;
+
+proxy_http_version 1.1;
+proxy_set_header Host $host;
+proxy_set_header X-Forwarded-For $remote_addr;
+proxy_set_header X-Forwarded-Proto $scheme;
+proxy_set_header Upgrade $http_upgrade;
+proxy_set_header Connection $connection_upgrade;
+
+map $http_upgrade $connection_upgrade {
+    default upgrade;
+    "" close;
+}
+
+map $scheme $dotege_hsts {
+    https "max-age=15768000";
+    default "";
+}
+
+server {
+    listen 80 default_server;
+    listen [::]:80 default_server;
+    listen 443 ssl default_server;
+    listen [::]:443 ssl default_server;
+    ssl_reject_handshake on;
+    return 444;
+}
+{{- end }}
+
+{{- block "auth" . }}
+{{- range .Hostnames }}
+{{- range .Routes }}
+{{- if and .RequiresAuth .AuthGroup }}
+{{- $group := .AuthGroup }}
+
+# Users in the {{ $group }} group. Requests without a user are allowed so that nginx will prompt for credentials.
+map $remote_user $dotege_auth_{{ template "auth_variable" . }} {
+    default 0;
+    "" 1;
+    {{- range $.Users }}
+    {{- if contains $group .Groups }}
+    {{ .Name | quote }} 1;
+    {{- end }}
+    {{- end }}
+}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- block "upstreams" . }}
+{{- range .Hostnames }}
+{{- range .Routes }}
+{{- $proxied := false }}
+{{- range .Containers }}{{ if .ShouldProxy }}{{ $proxied = true }}{{ end }}{{ end }}
+{{- if $proxied }}
+
+{{ template "upstream" . }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- block "servers" . }}
+{{- range .Hostnames }}
+{{- if .CertificateFile }}
+
+server {
+    listen 80;
+    listen [::]:80;
+    server_name {{ .Name }}{{ range .Alternatives }} {{ . }}{{ end }};
+    {{- template "acme" $.AcmeHttpBackend }}
+
+    location / {
+        return 301 https://$host$request_uri;
+    }
+}
+
+server {
+    listen 443 ssl http2;
+    listen [::]:443 ssl http2;
+    server_name {{ .Name }}{{ range .Alternatives }} {{ . }}{{ end }};
+    ssl_certificate {{ .CertificateFile }};
+    ssl_certificate_key {{ .KeyFile }};
+    {{- range .Routes }}
+    {{- template "location" . }}
+    {{- end }}
+}
+{{- else }}
+
+server {
+    listen 80;
+    listen [::]:80;
+    server_name {{ .Name }}{{ range .Alternatives }} {{ . }}{{ end }};
+    {{- template "acme" $.AcmeHttpBackend }}
+    {{- range .Routes }}
+    {{- template "location" . }}
+    {{- end }}
+}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- /* upstream is used for each route that has containers to proxy to, with the route as its data. */ -}}
+{{- define "upstream" -}}
+upstream {{ .Name }} {
+    {{- $balance := .Balance }}
+    {{- if eq $balance "leastconn" }}
+    least_conn;
+    {{- else if eq $balance "source" }}
+    ip_hash;
+    {{- end }}
+    {{- range .Containers }}
+        {{- if .ShouldProxy }}
+    server {{ .Name }}:{{ .Port }}
+            {{- if gt .Weight 0 }} weight={{ .Weight }}{{ else if eq .Weight 0 }} down{{ end }}
+            {{- if and .Backup (ne $balance "source") }} backup{{ end }};
+        {{- end }}
+    {{- end }}
+}
+{{- end }}
+
+{{- /*
+    location is used for each route, with the route as its data. Paths such as "/api" are matched exactly and
+    as a directory, so that they don't also match "/apiv2".
+*/ -}}
+{{- define "location" }}
+{{- if or (eq .Path "/") (hasSuffix "/" .Path) }}
+
+    location {{ .Path | quote }} {
+        {{- template "location_body" . }}
+    }
+{{- else }}
+
+    location = {{ .Path | quote }} {
+        {{- template "location_body" . }}
+    }
+
+    location {{ printf "%s/" .Path | quote }} {
+        {{- template "location_body" . }}
+    }
+{{- end }}
+{{- end }}
+
+{{- /* location_body is the content of each location block, with the route as its data. */ -}}
+{{- define "location_body" }}
+        {{- if .RequiresAuth }}
+        {{- if .AuthGroup }}
+        if ($dotege_auth_{{ template "auth_variable" . }} = 0) {
+            return 403;
+        }
+        {{- end }}
+        auth_basic "Restricted";
+        auth_basic_user_file /etc/nginx/htpasswd;
+        {{- end }}
+        {{- $proxied := false }}
+        {{- range .Containers }}{{ if .ShouldProxy }}{{ $proxied = true }}{{ end }}{{ end }}
+        {{- if $proxied }}
+        proxy_pass http://{{ .Name }};
+        {{- else }}
+        return 502;
+        {{- end }}
+        add_header Strict-Transport-Security $dotege_hsts always;
+        {{- range $k, $v := .Headers }}
+        add_header {{ $k }} {{ $v | quote }} always;
+        {{- end }}
+{{- end }}
+
+{{- /*
+    auth_variable is the suffix of the variable holding whether the user may access a route, with the route as its
+    data. nginx variables can't contain hyphens, and route names never contain "_H", so this keeps them distinct.
+*/ -}}
+{{- define "auth_variable" }}{{ .Name | replace "-" "_H" }}{{ end }}
+
+{{- /* acme is used in each server listening on port 80, with the ACME HTTP backend (if any) as its data. */ -}}
+{{- define "acme" }}
+    {{- if . }}
+
+    location /.well-known/acme-challenge/ {
+        proxy_pass http://{{ . }};
+    }
+    {{- end }}
+{{- end }}
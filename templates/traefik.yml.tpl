@@ -0,0 +1,130 @@
+{{- /*
+    Generates a Traefik dynamic configuration file for use with the file provider. Routers use the "web" and
+    "websecure" entry points, which should listen on ports 80 and 443 respectively. Certificates are read from
+    the paths dotege deploys them to, so the certificate volume should be mounted at the same path in the
+    Traefik container.
+
+    Traefik doesn't support per-server weights or backup servers in the file provider, so these are ignored.
+    Basic auth passwords must be hashed using MD5, SHA1 or bcrypt.
+
+    Each section of this template is a named block, which can be replaced by defining a block with the same
+    name in a partial template. See the README for details.
+*/ -}}
+
+http:
+  routers:
+    {{- block "routers" . }}
+    {{- if .AcmeHttpBackend }}
+    dotege_acme:
+      entryPoints: [web]
+      rule: "PathPrefix(`/.well-known/acme-challenge/`)"
+      priority: 10000
+      service: dotege_acme
+    {{- end }}
+    {{- range .Hostnames }}
+    {{- $host := . }}
+    {{- range .Routes }}
+    {{- $rule := printf "Host(`%s`)" $host.Name }}
+    {{- range $host.Alternatives }}{{ $rule = printf "%s || Host(`%s`)" $rule . }}{{ end }}
+    {{- if hasSuffix "/" .Path }}{{ if ne .Path "/" }}{{ $rule = printf "(%s) && PathPrefix(`%s`)" $rule .Path }}{{ end }}
+    {{- else }}{{ $rule = printf "(%s) && (Path(`%s`) || PathPrefix(`%s/`))" $rule .Path .Path }}{{ end }}
+    {{- if $host.CertificateFile }}
+    {{ .Name }}_redirect:
+      entryPoints: [web]
+      rule: {{ $rule | yamlQuote }}
+      middlewares: [dotege_redirect]
+      service: noop@internal
+    {{ .Name }}:
+      entryPoints: [websecure]
+      rule: {{ $rule | yamlQuote }}
+      tls: {}
+    {{- else }}
+    {{ .Name }}:
+      entryPoints: [web]
+      rule: {{ $rule | yamlQuote }}
+    {{- end }}
+      service: {{ .Name }}
+      middlewares:
+        - dotege_headers
+        {{- if .Headers }}
+        - {{ .Name }}_headers
+        {{- end }}
+        {{- if .RequiresAuth }}
+        - {{ .Name }}_auth
+        {{- end }}
+    {{- end }}
+    {{- end }}
+    {{- end }}
+
+  services:
+    {{- block "services" . }}
+    {{- if .AcmeHttpBackend }}
+    dotege_acme:
+      loadBalancer:
+        servers:
+          - url: {{ printf "http://%s" .AcmeHttpBackend | yamlQuote }}
+    {{- end }}
+    {{- range .Hostnames }}
+    {{- range .Routes }}
+    {{ .Name }}:
+      loadBalancer:
+        servers:
+        {{- range .Containers }}
+          {{- if .ShouldProxy }}
+          - url: {{ printf "http://%s:%d" .Name .Port | yamlQuote }}
+          {{- end }}
+        {{- end }}
+    {{- end }}
+    {{- end }}
+    {{- end }}
+
+  middlewares:
+    {{- block "middlewares" . }}
+    dotege_redirect:
+      redirectScheme:
+        scheme: https
+        permanent: true
+    dotege_headers:
+      headers:
+        stsSeconds: 15768000
+    {{- $users := .Users }}
+    {{- range .Hostnames }}
+    {{- range .Routes }}
+    {{- if .Headers }}
+    {{ .Name }}_headers:
+      headers:
+        customResponseHeaders:
+          {{- range $k, $v := .Headers }}
+          {{ $k | yamlQuote }}: {{ $v | yamlQuote }}
+          {{- end }}
+    {{- end }}
+    {{- if .RequiresAuth }}
+    {{- $group := .AuthGroup }}
+    {{ .Name }}_auth:
+      basicAuth:
+        users:
+          {{- range $users }}
+          {{- if or (not $group) (contains $group .Groups) }}
+          - {{ printf "%s:%s" .Name .Password | yamlQuote }}
+          {{- end }}
+          {{- end }}
+    {{- end }}
+    {{- end }}
+    {{- end }}
+    {{- end }}
+
+{{- block "tls" . }}
+{{- $first := true }}
+{{- range .Hostnames }}
+{{- if .CertificateFile }}
+{{- if $first }}
+
+tls:
+  certificates:
+{{- $first = false }}
+{{- end }}
+    - certFile: {{ .CertificateFile | yamlQuote }}
+      keyFile: {{ .KeyFile | yamlQuote }}
+{{- end }}
+{{- end }}
+{{- end }}